@@ -0,0 +1,99 @@
+package backend
+
+import (
+	"container/list"
+	"database/sql"
+	"github.com/cranewill/logcrane/def"
+	"log"
+)
+
+// SaveTable records the table in the catalog table, which is created when the first table is recorded.
+// A new table is given the next sequence in the catalog. The creation time and the sequence of a
+// recorded table are kept, and its row estimate is refreshed
+func (b *SqlBackend) SaveTable(entry def.TableEntry) error {
+	catalog := entry.TableName()
+	b.mu.Lock()
+	ready := b.catalogReady
+	b.mu.Unlock()
+	if !ready {
+		if err := b.EnsureTable(entry, catalog, entry.SaveType(), entry.RollType()); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		b.catalogReady = true
+		b.mu.Unlock()
+	}
+	d := b.Dialect
+	b.catalogMu.Lock()
+	defer b.catalogMu.Unlock()
+	var createdAt, seq int64
+	err := b.Db.QueryRow("SELECT "+d.Quote("created_at")+", "+d.Quote("seq")+" FROM "+d.Quote(catalog)+" WHERE "+
+		d.Quote("table_name")+" = "+d.Placeholder(1), entry.TableFullName).Scan(&createdAt, &seq)
+	if err == nil {
+		entry.CreatedAt, entry.Seq = createdAt, seq
+	} else if err != sql.ErrNoRows {
+		return err
+	} else if err = b.Db.QueryRow("SELECT COALESCE(MAX(" + d.Quote("seq") + "), 0) + 1 FROM " + d.Quote(catalog)).Scan(&entry.Seq); err != nil {
+		return err
+	}
+	if entry.RowEstimate, err = b.estimateRows(entry.TableFullName); err != nil {
+		log.Println("Estimate rows of " + entry.TableFullName + " error!")
+		log.Println(err)
+	}
+	entries := list.New()
+	entries.PushBack(entry)
+	return b.UpsertBatch(entries, catalog)
+}
+
+// Tables returns the recorded tables of the log whose periods overlap [from, to) in unix seconds,
+// ordered by their periods. The tables not rolled overlap any time
+func (b *SqlBackend) Tables(logTable string, from, to int64) ([]def.TableEntry, error) {
+	d := b.Dialect
+	catalog := def.TableEntry{}.TableName()
+	var s string
+	if err := b.Db.QueryRow(b.TableExistsSql, catalog).Scan(&s); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	columns := []string{"log_table", "table_name", "roll_type", "period_start", "period_end", "schema_hash", "columns", "created_at", "seq", "row_estimate"}
+	quoted := ""
+	for i, column := range columns {
+		if i > 0 {
+			quoted += ", "
+		}
+		quoted += d.Quote(column)
+	}
+	rows, err := b.Db.Query("SELECT "+quoted+" FROM "+d.Quote(catalog)+" WHERE "+d.Quote("log_table")+" = "+d.Placeholder(1)+
+		" AND "+d.Quote("period_start")+" < "+d.Placeholder(2)+" AND ("+d.Quote("period_end")+" = 0 OR "+
+		d.Quote("period_end")+" > "+d.Placeholder(3)+") ORDER BY "+d.Quote("period_start"), logTable, to, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]def.TableEntry, 0)
+	for rows.Next() {
+		var entry def.TableEntry
+		if err := rows.Scan(&entry.LogTable, &entry.TableFullName, &entry.Roll, &entry.PeriodStart, &entry.PeriodEnd,
+			&entry.SchemaHash, &entry.Columns, &entry.CreatedAt, &entry.Seq, &entry.RowEstimate); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// estimateRows returns the estimated rows of the table by RowsSql, or counts them if it is empty
+func (b *SqlBackend) estimateRows(tableFullName string) (int64, error) {
+	var rows sql.NullInt64
+	var err error
+	if b.RowsSql != "" {
+		err = b.Db.QueryRow(b.RowsSql, tableFullName).Scan(&rows)
+	} else {
+		err = b.Db.QueryRow("SELECT COUNT(*) FROM " + b.Dialect.Quote(tableFullName)).Scan(&rows)
+	}
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return rows.Int64, err
+}
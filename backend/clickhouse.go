@@ -0,0 +1,254 @@
+package backend
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"log"
+	"strings"
+	"time"
+)
+
+// ClickhouseBackend saves the logs into clickhouse. Instead of rolling physical tables,
+// every log type has one MergeTree table partitioned by the create time according to
+// its roll type, and the logs of def.Update type are saved in a ReplacingMergeTree
+// table ordered by the primary key, so the old rows are replaced when merging
+type ClickhouseBackend struct {
+	Db *sql.DB
+}
+
+// OpenClickhouse opens a clickhouse backend, the dsn looks like
+// "tcp://127.0.0.1:9000?database=log_db&username=default"
+func OpenClickhouse(dsn string) (*ClickhouseBackend, error) {
+	db, err := sql.Open("clickhouse", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// test db handle
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewClickhouseBackend(db), nil
+}
+
+// NewClickhouseBackend initializes a clickhouse backend with an opened db handle
+func NewClickhouseBackend(db *sql.DB) *ClickhouseBackend {
+	return &ClickhouseBackend{Db: db}
+}
+
+// EnsureTable creates the table of the log if it not exists. The rolled table name is
+// ignored, because the rolling is done by the partitions of the table
+func (b *ClickhouseBackend) EnsureTable(cLog def.Logger, tableFullName string, saveType, rollType int32) error {
+	tableName := cLog.TableName()
+	var s string
+	err := b.Db.QueryRow("SELECT name FROM system.tables WHERE database = currentDatabase() AND name = ?", tableName).Scan(&s)
+	if err == nil {
+		return nil
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	// table not exist in db
+	stmt := getClickhouseCreateSql(cLog, saveType, rollType)
+	_, err = b.Db.Exec(stmt)
+	log.Println("Create table ", tableName)
+	if err != nil {
+		log.Println(stmt)
+		return err
+	}
+	return nil
+}
+
+// InsertOne inserts a single cLog
+func (b *ClickhouseBackend) InsertOne(cLog def.Logger, tableFullName string) error {
+	logs := list.New()
+	logs.PushBack(cLog)
+	return b.InsertBatch(logs, tableFullName)
+}
+
+// InsertBatch inserts numbers of logs in one block
+func (b *ClickhouseBackend) InsertBatch(logs *list.List, tableFullName string) error {
+	return b.InsertBatchContext(context.Background(), logs, tableFullName)
+}
+
+// InsertBatchContext is like InsertBatch, the write is canceled when ctx is done,
+// or after writeTimeout if ctx has no deadline
+func (b *ClickhouseBackend) InsertBatchContext(ctx context.Context, logs *list.List, tableFullName string) error {
+	if logs.Len() == 0 {
+		return nil
+	}
+	cLog := logs.Front().Value.(def.Logger)
+	columns := make([]string, 0)
+	for _, field := range utils.GetFields(cLog, true) {
+		if strings.ToLower(field.Name) != def.NamePkId {
+			columns = append(columns, clickhouseQuote(field.Name))
+		}
+	}
+	insertStmt := "INSERT INTO " + clickhouseQuote(cLog.TableName()) + " (" + strings.Join(columns, ",") + ") VALUES (" +
+		strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, writeTimeout)
+		defer cancel()
+	}
+	// the clickhouse driver sends the rows in one block when the transaction commits
+	tx, err := b.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, insertStmt)
+	if err != nil {
+		tx.Rollback()
+		log.Println(insertStmt)
+		return err
+	}
+	defer stmt.Close()
+	for e := logs.Front(); e != nil; e = e.Next() {
+		if _, err := stmt.ExecContext(ctx, getClickhouseArgs(e.Value.(def.Logger))...); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpsertBatch inserts the logs into the ReplacingMergeTree table, the rows with
+// the same primary key are replaced by the newest one when clickhouse merges them.
+// Query the table with FINAL to get the merged result
+func (b *ClickhouseBackend) UpsertBatch(logs *list.List, tableFullName string) error {
+	return b.UpsertBatchContext(context.Background(), logs, tableFullName)
+}
+
+// UpsertBatchContext is like UpsertBatch, the write is canceled when ctx is done
+func (b *ClickhouseBackend) UpsertBatchContext(ctx context.Context, logs *list.List, tableFullName string) error {
+	return b.InsertBatchContext(ctx, logs, tableFullName)
+}
+
+// Close closes the db handle
+func (b *ClickhouseBackend) Close() error {
+	return b.Db.Close()
+}
+
+// clickhouseQuote quotes the identifier
+func clickhouseQuote(name string) string {
+	return "`" + strings.Replace(name, "`", "\\`", -1) + "`"
+}
+
+// getClickhouseType returns the clickhouse column type of the def column type
+func getClickhouseType(fieldType string) string {
+	switch strings.ToLower(fieldType) {
+	case def.TINY_INT:
+		return "Int8"
+	case def.SMALL_INT:
+		return "Int16"
+	case def.MEDIUMINT, def.INT:
+		return "Int32"
+	case def.BIG_INT:
+		return "Int64"
+	case def.FLOAT:
+		return "Float32"
+	case def.DOUBLE:
+		return "Float64"
+	case def.DATE:
+		return "Date"
+	case def.DATETIME, def.TIMESTAMP:
+		return "DateTime"
+	default:
+		return "String"
+	}
+}
+
+// getClickhousePartition returns the PARTITION BY expression of the roll type on the
+// create time column, or "" if the table is not rolled
+func getClickhousePartition(createTime def.ColumnDef, rollType int32) string {
+	column := clickhouseQuote(createTime.Name)
+	if t := getClickhouseType(createTime.Type); t != "Date" && t != "DateTime" {
+		column = "toDateTime(" + column + ")" // unix seconds
+	}
+	switch rollType {
+	case def.RollTypeHour, def.RollTypeDay: // hourly partitions are too many parts for MergeTree
+		return "toYYYYMMDD(" + column + ")"
+	case def.RollTypeWeek:
+		return "toMonday(" + column + ")"
+	case def.RollTypeMonth:
+		return "toYYYYMM(" + column + ")"
+	case def.RollTypeYear:
+		return "toYear(" + column + ")"
+	}
+	return ""
+}
+
+// getClickhouseCreateSql returns the CREATE TABLE statement of the log saved by saveType and
+// partitioned by rollType. The table is ordered by the primary key or the first index, followed by the create time
+func getClickhouseCreateSql(cLog def.Logger, saveType, rollType int32) string {
+	fields := utils.GetFields(cLog, true)
+	primary, indexNames, indexes := utils.GetKeys(fields)
+	columns := make([]string, 0, len(fields))
+	var createTime *def.ColumnDef
+	for i, field := range fields {
+		if strings.ToLower(field.Name) == def.NamePkId {
+			continue
+		}
+		if strings.ToLower(field.Name) == def.NameCreateTime {
+			createTime = &fields[i]
+		}
+		columns = append(columns, clickhouseQuote(field.Name)+" "+getClickhouseType(field.Type))
+	}
+	var orderBy []string
+	if primary != "" && strings.ToLower(primary) != def.NamePkId {
+		orderBy = append(orderBy, clickhouseQuote(primary))
+	} else if len(indexNames) > 0 {
+		for _, column := range indexes[indexNames[0]] {
+			orderBy = append(orderBy, clickhouseQuote(column))
+		}
+	}
+	engine := "MergeTree()"
+	if saveType == def.Update {
+		engine = "ReplacingMergeTree()"
+	} else if createTime != nil {
+		orderBy = append(orderBy, clickhouseQuote(createTime.Name))
+	}
+	stmt := "CREATE TABLE IF NOT EXISTS " + clickhouseQuote(cLog.TableName()) + "\n (" + strings.Join(columns, ",\n") + "\n) ENGINE = " + engine
+	if createTime != nil {
+		if partition := getClickhousePartition(*createTime, rollType); partition != "" {
+			stmt += "\nPARTITION BY " + partition
+		}
+	}
+	if len(orderBy) == 0 {
+		return stmt + "\nORDER BY tuple()"
+	}
+	return stmt + "\nORDER BY (" + strings.Join(orderBy, ", ") + ")"
+}
+
+// getClickhouseArgs returns the values of the log in the types the clickhouse driver accepts
+func getClickhouseArgs(cLog def.Logger) []interface{} {
+	fields := utils.GetFields(cLog, false)
+	args := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		if strings.ToLower(field.Name) == def.NamePkId {
+			continue
+		}
+		value := utils.GetTypedValue(field)
+		switch getClickhouseType(field.Type) {
+		case "Int8", "Int16", "Int32", "Int64":
+			if value == nil {
+				value = int64(0)
+			}
+		case "Float32", "Float64":
+			if value == nil {
+				value = float64(0)
+			}
+		case "Date":
+			value, _ = time.ParseInLocation("2006-01-02", field.Value, time.Local)
+		case "DateTime":
+			value, _ = time.ParseInLocation("2006-01-02 15:04:05", field.Value, time.Local)
+		}
+		args = append(args, value)
+	}
+	return args
+}
@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/csv"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// OpenCsv opens a file backend writing CSV files. The dsn is the directory of the files,
+// add "?gzip=true" to compress the files of the past rolled tables, like "/data/logs?gzip=true"
+func OpenCsv(dsn string) (def.Backend, error) {
+	return openDelimited(dsn, CsvEncoder{})
+}
+
+// OpenTsv opens a file backend writing TSV files which can be loaded by mysql LOAD DATA
+// with the default options. The dsn is the same as OpenCsv
+func OpenTsv(dsn string) (def.Backend, error) {
+	return openDelimited(dsn, TsvEncoder{})
+}
+
+// openDelimited parses the options in the dsn and opens the file backend
+func openDelimited(dsn string, encoder LineEncoder) (def.Backend, error) {
+	dir := dsn
+	var gzip bool
+	if i := strings.LastIndex(dsn, "?"); i >= 0 {
+		dir = dsn[:i]
+		query, err := url.ParseQuery(dsn[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if value := query.Get("gzip"); value != "" {
+			if gzip, err = strconv.ParseBool(value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	b, err := NewFileBackend(dir, encoder)
+	if err != nil {
+		return nil, err
+	}
+	b.Gzip = gzip
+	return b, nil
+}
+
+// getColumnsAndValues returns the column names and the values of the log, except 'pk_id'
+func getColumnsAndValues(cLog def.Logger) ([]string, []interface{}) {
+	fields := utils.GetFields(cLog, false)
+	columns := make([]string, 0, len(fields))
+	values := make([]interface{}, 0, len(fields))
+	for _, field := range fields {
+		if strings.ToLower(field.Name) == def.NamePkId {
+			continue
+		}
+		columns = append(columns, field.Name)
+		values = append(values, utils.GetTypedValue(field))
+	}
+	return columns, values
+}
+
+// formatValue returns the text of the value, the floats are written without exponent
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		return v
+	}
+	return ""
+}
+
+// CsvEncoder encodes the logs as RFC 4180 CSV lines with a header line of column names.
+// The values containing commas, quotes or newlines are quoted
+type CsvEncoder struct{}
+
+func (e CsvEncoder) Ext() string {
+	return ".csv"
+}
+
+func (e CsvEncoder) Header(cLog def.Logger) []byte {
+	columns, _ := getColumnsAndValues(cLog)
+	return e.encode(columns)
+}
+
+func (e CsvEncoder) Encode(cLog def.Logger) []byte {
+	_, values := getColumnsAndValues(cLog)
+	record := make([]string, 0, len(values))
+	for _, value := range values {
+		record = append(record, formatValue(value))
+	}
+	return e.encode(record)
+}
+
+func (e CsvEncoder) encode(record []string) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(record)
+	w.Flush()
+	return buf.Bytes()
+}
+
+// TsvEncoder encodes the logs as tab separated lines with a header line of column names.
+// It escapes like mysql LOAD DATA: backslash, tab, newline and carriage return are written
+// as \\, \t, \n and \r, and NULL is written as \N
+type TsvEncoder struct{}
+
+var tsvReplacer = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r", "\x00", "\\0")
+
+func (e TsvEncoder) Ext() string {
+	return ".tsv"
+}
+
+func (e TsvEncoder) Header(cLog def.Logger) []byte {
+	columns, _ := getColumnsAndValues(cLog)
+	for i, column := range columns {
+		columns[i] = tsvReplacer.Replace(column)
+	}
+	return []byte(strings.Join(columns, "\t") + "\n")
+}
+
+func (e TsvEncoder) Encode(cLog def.Logger) []byte {
+	_, values := getColumnsAndValues(cLog)
+	record := make([]string, 0, len(values))
+	for _, value := range values {
+		if value == nil {
+			record = append(record, "\\N")
+			continue
+		}
+		record = append(record, tsvReplacer.Replace(formatValue(value)))
+	}
+	return []byte(strings.Join(record, "\t") + "\n")
+}
@@ -0,0 +1,77 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+	"go.mongodb.org/mongo-driver/mongo"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// IsTransient returns whether the error may disappear by saving the logs again, like lost
+// connections, timeouts, deadlocks and busy databases. The other errors, like bad sql and
+// bad data, fail again
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err {
+	case driver.ErrBadConn, sql.ErrConnDone, mysql.ErrInvalidConn, io.EOF, io.ErrUnexpectedEOF, context.DeadlineExceeded:
+		return true
+	}
+	switch e := err.(type) {
+	case net.Error:
+		return true
+	case *mysql.MySQLError:
+		switch e.Number {
+		case 1040, 1053, 1205, 1213, 1317: // too many connections, shutdown, lock wait timeout, deadlock, interrupted
+			return true
+		}
+		return false
+	case *pq.Error:
+		code := string(e.Code)
+		// connection exceptions, serialization failure, deadlock, insufficient resources and shutdown
+		return strings.HasPrefix(code, "08") || code == "40001" || code == "40P01" ||
+			strings.HasPrefix(code, "53") || strings.HasPrefix(code, "57P")
+	case sqlite3.Error:
+		return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+	case *clickhouse.Exception:
+		switch e.Code {
+		case 159, 202, 209, 210, 252, 319: // timeout, too many queries, socket, network, too many parts, unknown insert status
+			return true
+		}
+		return false
+	}
+	return mongo.IsNetworkError(err) || mongo.IsTimeout(err)
+}
+
+// Transient classifies the database errors, see IsTransient
+func (b *SqlBackend) Transient(err error) bool {
+	return IsTransient(err)
+}
+
+// Transient classifies the clickhouse errors, see IsTransient
+func (b *ClickhouseBackend) Transient(err error) bool {
+	return IsTransient(err)
+}
+
+// Transient classifies the mongodb errors, see IsTransient
+func (b *MongoBackend) Transient(err error) bool {
+	return IsTransient(err)
+}
+
+// Transient classifies the file errors, a full disk may have room later
+func (b *FileBackend) Transient(err error) bool {
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err == syscall.ENOSPC
+	}
+	return IsTransient(err)
+}
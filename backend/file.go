@@ -0,0 +1,261 @@
+package backend
+
+import (
+	"bufio"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileBackend writes the logs into local files under a directory, one file for every rolled
+// table, so it needs no database at all. The file name is the rolled table name with the
+// extension of its encoder, like log_online_20261017.jsonl.
+// If Gzip is true, the file is compressed when it is closed for the file of a new table
+type FileBackend struct {
+	Dir     string
+	Encoder LineEncoder
+	Gzip    bool
+	files   map[string]*logFile // tableFullName -> the file of the opened rolled table
+	mu      sync.Mutex
+}
+
+// LineEncoder encodes the logs into the lines of a file
+type LineEncoder interface {
+	Ext() string                   // the extension of the files, like ".jsonl"
+	Encode(cLog def.Logger) []byte // the line of the log, ending with '\n'
+	Header(cLog def.Logger) []byte // the first line of a new file, nil if no header
+}
+
+// logFile is an opened file of a rolled table
+type logFile struct {
+	tableName     string
+	tableFullName string
+	path          string
+	file          *os.File
+	writer        *bufio.Writer
+}
+
+// OpenJsonl opens a file backend writing JSON Lines, the dsn is the directory of the files
+func OpenJsonl(dsn string) (def.Backend, error) {
+	b, err := NewFileBackend(dsn, JsonlEncoder{})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// NewFileBackend initializes a file backend, the directory is created if it not exists
+func NewFileBackend(dir string, encoder LineEncoder) (*FileBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileBackend{
+		Dir:     dir,
+		Encoder: encoder,
+		files:   make(map[string]*logFile),
+	}, nil
+}
+
+// EnsureTable opens the file of the rolled table, and closes the file of the
+// last rolled table of the same log
+func (b *FileBackend) EnsureTable(cLog def.Logger, tableFullName string, saveType, rollType int32) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.getFile(cLog, tableFullName)
+	return err
+}
+
+// InsertOne appends a single cLog
+func (b *FileBackend) InsertOne(cLog def.Logger, tableFullName string) error {
+	logs := list.New()
+	logs.PushBack(cLog)
+	return b.InsertBatch(logs, tableFullName)
+}
+
+// InsertBatch appends numbers of logs at one time
+func (b *FileBackend) InsertBatch(logs *list.List, tableFullName string) error {
+	if logs.Len() == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, err := b.getFile(logs.Front().Value.(def.Logger), tableFullName)
+	if err != nil {
+		return err
+	}
+	for e := logs.Front(); e != nil; e = e.Next() {
+		if _, err := f.writer.Write(b.Encoder.Encode(e.Value.(def.Logger))); err != nil {
+			return err
+		}
+	}
+	return f.writer.Flush()
+}
+
+// UpsertBatch appends the logs like InsertBatch, a file can not be updated in place.
+// The last line of the same primary key is the newest
+func (b *FileBackend) UpsertBatch(logs *list.List, tableFullName string) error {
+	return b.InsertBatch(logs, tableFullName)
+}
+
+// Close flushes, syncs and closes all the opened files
+func (b *FileBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lastErr error
+	for tableFullName, f := range b.files {
+		if err := f.close(); err != nil {
+			log.Println("Close file " + f.tableFullName + " error!")
+			log.Println(err)
+			lastErr = err
+		}
+		delete(b.files, tableFullName)
+	}
+	return lastErr
+}
+
+// getFile returns the opened file of the rolled table, it must be called with the lock held.
+// When the file of a new table is created, the files of the same log opened earlier are closed.
+// The late logs of an earlier table open its file again, the files opened are kept
+func (b *FileBackend) getFile(cLog def.Logger, tableFullName string) (*logFile, error) {
+	tableName := cLog.TableName()
+	if f, exist := b.files[tableFullName]; exist {
+		return f, nil
+	}
+	path := filepath.Join(b.Dir, tableFullName+b.Encoder.Ext())
+	if !fileExists(path) && !fileExists(path+".gz") {
+		for name, f := range b.files {
+			if f.tableName != tableName {
+				continue
+			}
+			delete(b.files, name)
+			if err := f.close(); err != nil {
+				log.Println("Close file " + f.tableFullName + " error!")
+				log.Println(err)
+			} else if b.Gzip {
+				if err := compressFile(f.path); err != nil {
+					log.Println("Compress file " + f.path + " error!")
+					log.Println(err)
+				}
+			}
+		}
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &logFile{
+		tableName:     tableName,
+		tableFullName: tableFullName,
+		path:          path,
+		file:          file,
+		writer:        bufio.NewWriter(file),
+	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		log.Println("Create file ", path)
+		if header := b.Encoder.Header(cLog); header != nil {
+			f.writer.Write(header)
+		}
+	}
+	b.files[tableFullName] = f
+	return f, nil
+}
+
+// fileExists returns whether the file exists
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// close flushes the buffer and syncs the file to disk before closing it
+func (f *logFile) close() error {
+	if err := f.writer.Flush(); err != nil {
+		f.file.Close()
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
+}
+
+// compressFile compresses the file into path.gz and removes it. If path.gz exists,
+// which happens when the log system restarted in the same roll period, the file is
+// compressed into the first not existing one of path.1.gz, path.2.gz ...
+func compressFile(path string) error {
+	gzPath := path + ".gz"
+	for i := 1; ; i++ {
+		if _, err := os.Stat(gzPath); os.IsNotExist(err) {
+			break
+		}
+		gzPath = path + "." + strconv.Itoa(i) + ".gz"
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(gzPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(gzPath)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// JsonlEncoder encodes every log as a JSON object in one line, the keys are the column names
+type JsonlEncoder struct{}
+
+func (e JsonlEncoder) Ext() string {
+	return ".jsonl"
+}
+
+func (e JsonlEncoder) Header(cLog def.Logger) []byte {
+	return nil
+}
+
+// Encode writes the columns in the order of the fields, 'pk_id' is skipped
+func (e JsonlEncoder) Encode(cLog def.Logger) []byte {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for _, field := range utils.GetFields(cLog, false) {
+		if strings.ToLower(field.Name) == def.NamePkId {
+			continue
+		}
+		if sb.Len() > 1 {
+			sb.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.Name)
+		value, err := json.Marshal(utils.GetTypedValue(field))
+		if err != nil { // NaN or Inf
+			value = []byte("null")
+		}
+		sb.Write(key)
+		sb.WriteByte(':')
+		sb.Write(value)
+	}
+	sb.WriteString("}\n")
+	return []byte(sb.String())
+}
@@ -0,0 +1,81 @@
+package backend
+
+import (
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"log"
+)
+
+// PlanMigration reads the columns and the indexes of the existing table, and returns the changes
+// making it fit the log without applying them. Missing columns and indexes are added and narrow
+// columns are widened, the destructive changes are refused unless AllowDestructive is true.
+// It returns no changes if the backend can not read the table structure
+func (b *SqlBackend) PlanMigration(cLog def.Logger, tableFullName string) (utils.Migration, error) {
+	if b.ColumnsSql == "" {
+		return utils.Migration{Table: tableFullName}, nil
+	}
+	rows, err := b.Db.Query(b.ColumnsSql, tableFullName)
+	if err != nil {
+		return utils.Migration{}, err
+	}
+	defer rows.Close()
+	columns := make([]def.ColumnDef, 0)
+	for rows.Next() {
+		var column def.ColumnDef
+		var length int64
+		if err := rows.Scan(&column.Name, &column.Type, &length); err != nil {
+			return utils.Migration{}, err
+		}
+		column.Type = utils.NormalizeType(column.Type)
+		if length > 0 && length < 1<<31 {
+			column.Length = int32(length)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return utils.Migration{}, err
+	}
+	indexNames := make([]string, 0)
+	if b.IndexesSql != "" {
+		indexRows, err := b.Db.Query(b.IndexesSql, tableFullName)
+		if err != nil {
+			return utils.Migration{}, err
+		}
+		defer indexRows.Close()
+		for indexRows.Next() {
+			var name string
+			if err := indexRows.Scan(&name); err != nil {
+				return utils.Migration{}, err
+			}
+			indexNames = append(indexNames, name)
+		}
+		if err := indexRows.Err(); err != nil {
+			return utils.Migration{}, err
+		}
+	}
+	return utils.GetMigration(b.Dialect, cLog, tableFullName, columns, indexNames, b.AllowDestructive), nil
+}
+
+// migrate applies the changes of PlanMigration, and reports the refused ones
+func (b *SqlBackend) migrate(cLog def.Logger, tableFullName string) error {
+	m, err := b.PlanMigration(cLog, tableFullName)
+	if err != nil {
+		return err
+	}
+	for i, stmt := range m.Sqls {
+		log.Println("Migrate table ", tableFullName, ": ", m.Changes[i])
+		if _, err := b.Db.Exec(stmt); err != nil {
+			log.Println(stmt)
+			return err
+		}
+	}
+	if len(m.Sqls) > 0 { // the prepared statements may keep the old columns
+		b.mu.Lock()
+		b.closeStmts(tableFullName)
+		b.mu.Unlock()
+	}
+	for _, change := range m.Refused {
+		log.Println("Refuse to migrate table ", tableFullName, ": ", change, ", it needs AllowDestructive")
+	}
+	return nil
+}
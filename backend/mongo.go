@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/connstring"
+	"log"
+	"strings"
+	"time"
+)
+
+// MongoBackend saves the logs into mongodb, every table is a collection
+// and every log is a document keyed by the 'name' tags
+type MongoBackend struct {
+	Client *mongo.Client
+	Db     *mongo.Database
+}
+
+// OpenMongo opens a mongodb backend, the dsn is a mongodb connection string
+// with the database name, like "mongodb://localhost:27017/log_db"
+func OpenMongo(dsn string) (def.Backend, error) {
+	cs, err := connstring.ParseAndValidate(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if cs.Database == "" {
+		return nil, errors.New("database name missing in mongodb dsn " + dsn)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dsn))
+	if err != nil {
+		return nil, err
+	}
+	// test db handle
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+	return NewMongoBackend(client, cs.Database), nil
+}
+
+// NewMongoBackend initializes a mongodb backend with a connected client
+func NewMongoBackend(client *mongo.Client, database string) *MongoBackend {
+	return &MongoBackend{
+		Client: client,
+		Db:     client.Database(database),
+	}
+}
+
+// EnsureTable creates the indexes of the collection not created yet, they are logged only if
+// any is created. The collection itself is created by mongodb when the first document is inserted
+func (b *MongoBackend) EnsureTable(cLog def.Logger, tableFullName string, saveType, rollType int32) error {
+	primary, indexNames, indexes := utils.GetKeys(utils.GetFields(cLog, true))
+	models := make([]mongo.IndexModel, 0, len(indexNames)+1)
+	if primary != "" && strings.ToLower(primary) != def.NamePkId {
+		models = append(models, mongo.IndexModel{
+			Keys:    bson.D{{Key: primary, Value: 1}},
+			Options: options.Index().SetName(def.IndexTypePK).SetUnique(true),
+		})
+	}
+	for _, name := range indexNames {
+		keys := bson.D{}
+		for _, column := range indexes[name] {
+			keys = append(keys, bson.E{Key: column, Value: 1})
+		}
+		models = append(models, mongo.IndexModel{Keys: keys, Options: options.Index().SetName(name)})
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	indexView := b.Db.Collection(tableFullName).Indexes()
+	specs, err := indexView.ListSpecifications(ctx) // empty if the collection not exists
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool, len(specs))
+	for _, spec := range specs {
+		existing[spec.Name] = true
+	}
+	missing := make([]mongo.IndexModel, 0, len(models))
+	for _, model := range models {
+		if !existing[*model.Options.Name] {
+			missing = append(missing, model)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	names, err := indexView.CreateMany(ctx, missing)
+	if err != nil {
+		return err
+	}
+	log.Println("Create indexes ", strings.Join(names, ", "), " of collection ", tableFullName)
+	return nil
+}
+
+// InsertOne inserts a single cLog
+func (b *MongoBackend) InsertOne(cLog def.Logger, tableFullName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := b.Db.Collection(tableFullName).InsertOne(ctx, getDocument(cLog))
+	return err
+}
+
+// InsertBatch inserts numbers of logs at one time
+func (b *MongoBackend) InsertBatch(logs *list.List, tableFullName string) error {
+	if logs.Len() == 0 {
+		return nil
+	}
+	docs := make([]interface{}, 0, logs.Len())
+	for cLog := logs.Front(); cLog != nil; cLog = cLog.Next() {
+		docs = append(docs, getDocument(cLog.Value.(def.Logger)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := b.Db.Collection(tableFullName).InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+// UpsertBatch updates the documents which have the same primary key with the logs,
+// and inserts the logs which not exist
+func (b *MongoBackend) UpsertBatch(logs *list.List, tableFullName string) error {
+	if logs.Len() == 0 {
+		return nil
+	}
+	primary, _, _ := utils.GetKeys(utils.GetFields(logs.Front().Value.(def.Logger), true))
+	if primary == "" || strings.ToLower(primary) == def.NamePkId {
+		return errors.New("no primary key to upsert " + tableFullName)
+	}
+	models := make([]mongo.WriteModel, 0, logs.Len())
+	for cLog := logs.Front(); cLog != nil; cLog = cLog.Next() {
+		doc := getDocument(cLog.Value.(def.Logger))
+		var key interface{}
+		for _, e := range doc {
+			if e.Key == primary {
+				key = e.Value
+				break
+			}
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: primary, Value: key}}).
+			SetUpdate(bson.D{{Key: "$set", Value: doc}}).
+			SetUpsert(true))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := b.Db.Collection(tableFullName).BulkWrite(ctx, models)
+	return err
+}
+
+// Close disconnects from mongodb
+func (b *MongoBackend) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return b.Client.Disconnect(ctx)
+}
+
+// getDocument returns the bson document of the log. The 'pk_id' column is
+// skipped because mongodb has its own '_id'
+func getDocument(cLog def.Logger) bson.D {
+	fields := utils.GetFields(cLog, false)
+	doc := make(bson.D, 0, len(fields))
+	for _, field := range fields {
+		if strings.ToLower(field.Name) == def.NamePkId {
+			continue
+		}
+		doc = append(doc, bson.E{Key: field.Name, Value: utils.GetTypedValue(field)})
+	}
+	return doc
+}
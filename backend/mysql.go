@@ -0,0 +1,33 @@
+package backend
+
+import (
+	"database/sql"
+	"github.com/cranewill/logcrane/utils"
+	_ "github.com/go-sql-driver/mysql"
+)
+
+// OpenMysql opens a mysql backend, the dsn looks like "user:pwd@/db?charset=utf8mb4"
+func OpenMysql(dsn string) (*SqlBackend, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// test db handle
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewMysqlBackend(db), nil
+}
+
+// NewMysqlBackend initializes a mysql backend with an opened db handle
+func NewMysqlBackend(db *sql.DB) *SqlBackend {
+	b := NewSqlBackend(db, utils.MysqlDialect{}, "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?;")
+	b.ColumnsSql = "SELECT column_name, data_type, IFNULL(character_maximum_length, 0) FROM information_schema.columns " +
+		"WHERE table_schema = DATABASE() AND table_name = ? ORDER BY ordinal_position;"
+	b.IndexesSql = "SELECT DISTINCT index_name FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ?;"
+	b.RowsSql = "SELECT table_rows FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?;"
+	b.TablesSql = "SELECT table_name FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name LIKE ?;"
+	return b
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/cranewill/logcrane/def"
+	"io"
+	"strings"
+)
+
+// ListTables returns the tables whose names start with logTable
+func (b *SqlBackend) ListTables(logTable string) ([]string, error) {
+	if b.TablesSql == "" {
+		return nil, nil
+	}
+	rows, err := b.Db.Query(b.TablesSql, logTable+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(table, logTable) { // '_' matches any character in LIKE
+			tables = append(tables, table)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// DropTable drops the table and its cached statements
+func (b *SqlBackend) DropTable(tableFullName string) error {
+	b.forget(tableFullName)
+	_, err := b.Db.Exec("DROP TABLE IF EXISTS " + b.Dialect.Quote(tableFullName) + ";")
+	return err
+}
+
+// ArchiveTable moves the table into the schema, see Dialect.ArchiveTable
+func (b *SqlBackend) ArchiveTable(tableFullName, schema string) error {
+	b.forget(tableFullName)
+	_, err := b.Db.Exec(b.Dialect.ArchiveTable(tableFullName, schema))
+	return err
+}
+
+// ExportTable writes the rows of the table as json objects of column names to values, one per line
+func (b *SqlBackend) ExportTable(tableFullName string, w io.Writer) (int, error) {
+	rows, err := b.Db.Query("SELECT * FROM " + b.Dialect.Quote(tableFullName))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	encoder := json.NewEncoder(w)
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if bytes, ok := values[i].([]byte); ok { // the drivers return the text columns as bytes
+				row[column] = string(bytes)
+			} else {
+				row[column] = values[i]
+			}
+		}
+		if err := encoder.Encode(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// DeleteTable removes the table from the catalog table if it exists
+func (b *SqlBackend) DeleteTable(tableFullName string) error {
+	d := b.Dialect
+	catalog := def.TableEntry{}.TableName()
+	var s string
+	if err := b.Db.QueryRow(b.TableExistsSql, catalog).Scan(&s); err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err := b.Db.Exec("DELETE FROM "+d.Quote(catalog)+" WHERE "+d.Quote("table_name")+" = "+d.Placeholder(1), tableFullName)
+	return err
+}
+
+// forget closes the cached statements of the removed table
+func (b *SqlBackend) forget(tableFullName string) {
+	b.mu.Lock()
+	b.closeStmts(tableFullName)
+	for tableName, recent := range b.recentTables {
+		for i, name := range recent {
+			if name == tableFullName {
+				b.recentTables[tableName] = append(recent[:i], recent[i+1:]...)
+				break
+			}
+		}
+	}
+	b.mu.Unlock()
+}
@@ -0,0 +1,240 @@
+package backend
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"log"
+	"sync"
+	"time"
+)
+
+// maxCachedStmts limits the prepared statements cached for one rolled table. A statement
+// is prepared for every different number of rows, the batches with other numbers of
+// rows are executed without preparing
+const maxCachedStmts = 16
+
+// maxCachedTables limits the rolled tables of one log whose statements are cached. A batch
+// of late logs may be split into the tables of several periods, the statements of the least
+// recently used table are closed
+const maxCachedTables = 4
+
+// writeTimeout limits a write whose context has no deadline
+const writeTimeout = 5 * time.Second
+
+// SqlBackend saves the logs into a sql database, the statements are
+// written by its dialect with placeholders, and prepared once per rolled table
+type SqlBackend struct {
+	Db               *sql.DB
+	Dialect          utils.Dialect
+	TableExistsSql   string                            // the query selecting the table name, with the table name as its only argument
+	ColumnsSql       string                            // the query selecting the name, type and length of the columns, with the table name as its only argument
+	IndexesSql       string                            // the query selecting the index names, with the table name as its only argument
+	RowsSql          string                            // the query selecting the estimated rows, with the table name as its only argument. The rows are counted if it is empty
+	TablesSql        string                            // the query selecting the table names, with a LIKE pattern as its only argument
+	AllowDestructive bool                              // whether the migration drops the columns and changes the column types
+	stmts            map[string]map[string]*cachedStmt // tableFullName -> statement -> prepared statement
+	recentTables     map[string][]string               // tableName -> the tableFullNames its statements are cached for, the most recent last
+	catalogReady     bool                              // whether the catalog table is ensured
+	catalogMu        sync.Mutex                        // serializes the records of the catalog, so their sequences are unique
+	mu               sync.Mutex
+}
+
+// NewSqlBackend initializes a sql backend with an opened db handle
+func NewSqlBackend(db *sql.DB, dialect utils.Dialect, tableExistsSql string) *SqlBackend {
+	return &SqlBackend{
+		Db:             db,
+		Dialect:        dialect,
+		TableExistsSql: tableExistsSql,
+		stmts:          make(map[string]map[string]*cachedStmt),
+		recentTables:   make(map[string][]string),
+	}
+}
+
+// EnsureTable creates the table and its indexes if it not exists, or migrates the existing
+// table to fit the log, see PlanMigration
+func (b *SqlBackend) EnsureTable(cLog def.Logger, tableFullName string, saveType, rollType int32) error {
+	var s string
+	err := b.Db.QueryRow(b.TableExistsSql, tableFullName).Scan(&s)
+	if err == nil {
+		return b.migrate(cLog, tableFullName)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	// table not exist in db
+	log.Println("Create table ", tableFullName)
+	for _, stmt := range utils.GetCreateSqls(b.Dialect, cLog, tableFullName) {
+		if _, err := b.Db.Exec(stmt); err != nil {
+			log.Println(stmt)
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertOne inserts a single cLog
+func (b *SqlBackend) InsertOne(cLog def.Logger, tableFullName string) error {
+	logs := list.New()
+	logs.PushBack(cLog)
+	return b.InsertBatch(logs, tableFullName)
+}
+
+// InsertBatch inserts numbers of logs at one time
+func (b *SqlBackend) InsertBatch(logs *list.List, tableFullName string) error {
+	return b.InsertBatchContext(context.Background(), logs, tableFullName)
+}
+
+// UpsertBatch inserts the logs, and updates them if the primary key conflicts
+func (b *SqlBackend) UpsertBatch(logs *list.List, tableFullName string) error {
+	return b.UpsertBatchContext(context.Background(), logs, tableFullName)
+}
+
+// InsertBatchContext is like InsertBatch, the write is canceled when ctx is done
+func (b *SqlBackend) InsertBatchContext(ctx context.Context, logs *list.List, tableFullName string) error {
+	if logs.Len() == 0 {
+		return nil
+	}
+	stmt, args := utils.GetInsertSqlAndArgs(b.Dialect, logs, tableFullName)
+	return b.exec(ctx, logs.Front().Value.(def.Logger).TableName(), tableFullName, stmt, args)
+}
+
+// UpsertBatchContext is like UpsertBatch, the write is canceled when ctx is done
+func (b *SqlBackend) UpsertBatchContext(ctx context.Context, logs *list.List, tableFullName string) error {
+	if logs.Len() == 0 {
+		return nil
+	}
+	stmt, args := utils.GetUpsertSqlAndArgs(b.Dialect, logs, tableFullName)
+	return b.exec(ctx, logs.Front().Value.(def.Logger).TableName(), tableFullName, stmt, args)
+}
+
+// Close closes the prepared statements and the db handle
+func (b *SqlBackend) Close() error {
+	b.mu.Lock()
+	for tableFullName := range b.stmts {
+		b.closeStmts(tableFullName)
+	}
+	b.mu.Unlock()
+	return b.Db.Close()
+}
+
+// exec executes the statement within ctx, or writeTimeout if ctx has no deadline,
+// using the cached prepared statement
+func (b *SqlBackend) exec(ctx context.Context, tableName, tableFullName, stmt string, args []interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, writeTimeout)
+		defer cancel()
+	}
+	prepared, err := b.prepare(ctx, tableName, tableFullName, stmt)
+	if err == nil {
+		if prepared != nil {
+			_, err = prepared.stmt.ExecContext(ctx, args...)
+			b.release(prepared)
+		} else {
+			_, err = b.Db.ExecContext(ctx, stmt, args...)
+		}
+	}
+	if err != nil {
+		log.Println(stmt)
+		return err
+	}
+	return nil
+}
+
+// cachedStmt is a prepared statement shared by the writes of a rolled table
+type cachedStmt struct {
+	stmt    *sql.Stmt
+	users   int  // how many writes are using it, guarded by the lock of the backend
+	evicted bool // whether it is removed from the cache, it is closed by its last user
+}
+
+// prepare returns the cached prepared statement, or prepares and caches it. The statement must be
+// released after it is used. The statements of the least recently used rolled table of the same
+// log are evicted when there are more than maxCachedTables. It returns nil if the cache is full.
+// The statement is prepared without the lock, the one cached first is kept if another write
+// prepares it at the same time
+func (b *SqlBackend) prepare(ctx context.Context, tableName, tableFullName, stmt string) (*cachedStmt, error) {
+	if prepared, full := b.cached(tableName, tableFullName, stmt); prepared != nil || full {
+		return prepared, nil
+	}
+	s, err := b.Db.PrepareContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prepared, full := b.lookup(tableName, tableFullName, stmt)
+	if prepared != nil || full {
+		s.Close()
+		return prepared, nil
+	}
+	prepared = &cachedStmt{stmt: s, users: 1}
+	b.stmts[tableFullName][stmt] = prepared
+	return prepared, nil
+}
+
+// cached returns the cached prepared statement used by one more write, or nil and whether
+// the cache of the rolled table is full
+func (b *SqlBackend) cached(tableName, tableFullName, stmt string) (*cachedStmt, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lookup(tableName, tableFullName, stmt)
+}
+
+// lookup is cached with the lock held
+func (b *SqlBackend) lookup(tableName, tableFullName, stmt string) (*cachedStmt, bool) {
+	b.touch(tableName, tableFullName)
+	cached, exist := b.stmts[tableFullName]
+	if !exist {
+		cached = make(map[string]*cachedStmt)
+		b.stmts[tableFullName] = cached
+	}
+	if prepared, exist := cached[stmt]; exist {
+		prepared.users++
+		return prepared, false
+	}
+	return nil, len(cached) >= maxCachedStmts
+}
+
+// release marks the statement unused by a write, it is closed if it is evicted and unused
+func (b *SqlBackend) release(prepared *cachedStmt) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if prepared.users--; prepared.evicted && prepared.users == 0 {
+		prepared.stmt.Close()
+	}
+}
+
+// touch marks the rolled table as the most recently used one of the log, it must be called with the lock held
+func (b *SqlBackend) touch(tableName, tableFullName string) {
+	recent := b.recentTables[tableName]
+	if n := len(recent); n > 0 && recent[n-1] == tableFullName {
+		return
+	}
+	for i, name := range recent {
+		if name == tableFullName {
+			recent = append(recent[:i], recent[i+1:]...)
+			break
+		}
+	}
+	recent = append(recent, tableFullName)
+	if len(recent) > maxCachedTables {
+		b.closeStmts(recent[0])
+		recent = recent[1:]
+	}
+	b.recentTables[tableName] = recent
+}
+
+// closeStmts evicts the prepared statements of the rolled table, the unused ones are closed at once
+// and the others by their last users. It must be called with the lock held
+func (b *SqlBackend) closeStmts(tableFullName string) {
+	for _, prepared := range b.stmts[tableFullName] {
+		if prepared.evicted = true; prepared.users == 0 {
+			prepared.stmt.Close()
+		}
+	}
+	delete(b.stmts, tableFullName)
+}
@@ -0,0 +1,35 @@
+package backend
+
+import (
+	"database/sql"
+	"github.com/cranewill/logcrane/utils"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// OpenSqlite opens a sqlite backend, the dsn is the database file name like
+// "log.db" or "file:log.db?cache=shared". It needs no server, so it is fit
+// for local development and tests
+func OpenSqlite(dsn string) (*SqlBackend, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows only one writer at a time
+	db.SetMaxOpenConns(1)
+	// test db handle
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return NewSqliteBackend(db), nil
+}
+
+// NewSqliteBackend initializes a sqlite backend with an opened db handle
+func NewSqliteBackend(db *sql.DB) *SqlBackend {
+	b := NewSqlBackend(db, utils.SqliteDialect{}, "SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?;")
+	b.ColumnsSql = "SELECT name, type, 0 FROM pragma_table_info(?);"
+	b.IndexesSql = "SELECT name FROM sqlite_master WHERE type = 'index' AND tbl_name = ?;"
+	b.TablesSql = "SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE ?;"
+	return b
+}
@@ -0,0 +1,176 @@
+package core
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDeferred is returned when the log is not saved yet but deferred to the backfill file because
+// the log database is unavailable, it is saved when the database is available again
+var ErrDeferred = errors.New("log deferred because the log database is unavailable")
+
+// lastError returns err, unless it is nil or ErrDeferred while last is a failed write
+func lastError(last, err error) error {
+	if err == nil || err == ErrDeferred && last != nil {
+		return last
+	}
+	return err
+}
+
+// deferTasks writes the logs of the tasks to the backfill file of the table while the database
+// is unavailable, they are saved into the tables rolled by their own time when it is
+// available again, see utils.GetRollTime. The deferred logs are acknowledged in the write-ahead
+// log and finished with ErrDeferred, the ones can not be written go to the dead letter sink.
+// The backfill file is synced before the acknowledgement if Config.WalSync is true.
+// It returns how many logs failed, and ErrDeferred or the error of writing the file
+func (c *LogCrane) deferTasks(tableName string, tasks []task) (int, error) {
+	for i, t := range tasks {
+		if err := c.spiller.backfill(t.cLog, utils.GetRollTime(t.cLog).Unix()); err != nil {
+			log.Println("Defer log ", tableName, " error!")
+			log.Println(err)
+			c.ackDeferred(tableName, tasks[:i])
+			c.deadLetter(tableName, tasks[i:], err)
+			for j, t := range tasks {
+				if j < i {
+					t.finish(ErrDeferred)
+				} else {
+					t.finish(err)
+				}
+			}
+			atomic.AddUint64(&c.counter(tableName).Deferred, uint64(i))
+			return len(tasks) - i, err
+		}
+	}
+	c.ackDeferred(tableName, tasks)
+	for _, t := range tasks {
+		t.finish(ErrDeferred)
+	}
+	atomic.AddUint64(&c.counter(tableName).Deferred, uint64(len(tasks)))
+	return 0, ErrDeferred
+}
+
+// ackDeferred acknowledges the logs written to the backfill file in the write-ahead log. If
+// Config.WalSync is true the file is synced first, and the logs are kept in the write-ahead
+// log if it fails, they may be saved twice but not lost
+func (c *LogCrane) ackDeferred(tableName string, tasks []task) {
+	if c.wal == nil || len(tasks) == 0 {
+		return
+	}
+	if c.Config.WalSync {
+		if err := c.spiller.sync(tableName, backfillExt); err != nil {
+			log.Println("Sync backfill file ", tableName, " error!")
+			log.Println(err)
+			return
+		}
+	}
+	c.ack(tasks...)
+}
+
+// Backfill saves the deferred logs every interval while the database is available, the
+// backfill probes the database like the other writes when the circuit breaker is open
+func (c *LogCrane) Backfill(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if c.Status() != def.StatusLive {
+			continue
+		}
+		for _, tableName := range c.spiller.tables(backfillExt, backfillingExt) {
+			if err := c.backfillTable(tableName); err != nil {
+				log.Println("Backfill logs ", tableName, " error!")
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// backfillTable saves the deferred logs of the table in batches, the logs of a batch are all
+// created in the period of one rolled table. It stops when the database is unavailable again
+func (c *LogCrane) backfillTable(tableName string) error {
+	typ := c.spiller.logType(tableName)
+	table := c.Config.Table(tableName)
+	counter := c.counter(tableName)
+	created := make(map[string]bool) // the tables ensured by this time
+	return c.spiller.consume(tableName, backfillExt, backfillingExt, table.BatchSize, func(lines [][]byte) int {
+		if c.ctx.Err() != nil {
+			return 0
+		}
+		logs := list.New()
+		tasks := make([]task, 0, len(lines))
+		tableFullName := ""
+		saveType, rollType, createdAt := int32(def.Batch), int32(def.Never), time.Time{}
+		for _, line := range lines {
+			record := backfillRecord{}
+			err := json.Unmarshal(line, &record)
+			var cLog def.Logger
+			if err == nil {
+				cLog, err = decodeLog(typ, record.Log)
+			}
+			if err != nil {
+				if logs.Len() > 0 { // save the batch before it first
+					break
+				}
+				log.Println("Decode deferred log ", tableName, " error!")
+				log.Println(err)
+				return 1
+			}
+			if saveType = cLog.SaveType(); table.SaveType != 0 {
+				saveType = table.SaveType
+			}
+			if rollType = cLog.RollType(); saveType == def.Update {
+				rollType = def.Never
+			}
+			fullName := utils.GetLogTableFullName(cLog, rollType, time.Unix(record.Time, 0))
+			if tableFullName != "" && fullName != tableFullName {
+				break
+			}
+			tableFullName, createdAt = fullName, time.Unix(record.Time, 0)
+			logs.PushBack(cLog)
+			tasks = append(tasks, task{cLog: cLog})
+		}
+		if !c.breaker.allow() {
+			return 0
+		}
+		b := c.Backend()
+		var err error
+		if !created[tableFullName] {
+			if err = b.EnsureTable(tasks[0].cLog, tableFullName, saveType, rollType); err == nil {
+				created[tableFullName] = true
+				if catalog := c.catalog(); catalog != nil {
+					c.saveCatalog(catalog, c.catalogEntry(tasks[0].cLog, tableFullName, rollType, createdAt))
+				}
+			}
+		}
+		if err == nil {
+			if saveType == def.Update {
+				err = upsertBatch(c.ctx, b, logs, tableFullName)
+			} else {
+				err = insertBatch(c.ctx, b, logs, tableFullName)
+			}
+		}
+		if err != nil && (c.transient(err) || c.ctx.Err() != nil) { // the logs are kept in the file
+			c.breaker.failure()
+			return 0
+		}
+		c.breaker.success()
+		if err != nil {
+			c.deadLetter(tableName, tasks, err)
+		} else {
+			atomic.AddUint64(&counter.Backfilled, uint64(logs.Len()))
+			atomic.AddUint64(&counter.Count, uint64(logs.Len()))
+			atomic.AddUint64(&counter.TotalCount, uint64(logs.Len()))
+		}
+		return len(tasks)
+	})
+}
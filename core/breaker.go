@@ -0,0 +1,89 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// States of the circuit breaker
+const (
+	breakerClosed   = 0 // the logs are saved into the database
+	breakerOpen     = 1 // the database is unavailable, the logs are deferred to the backfill files
+	breakerHalfOpen = 2 // one write is probing the database
+)
+
+// breaker is the circuit breaker of the log database. It opens after threshold consecutive
+// writes failed with transient errors, then the workers defer the logs without touching the
+// database. After cooldown one write is let through to probe the database, the breaker closes
+// if it succeeds and opens again otherwise. It never opens if threshold is negative
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	state     int
+	failures  int       // consecutive failed writes
+	openUntil time.Time // when the next probe is let through
+}
+
+// newBreaker creates a closed circuit breaker
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// allow returns whether the write can go to the database, the write let through after
+// the cooldown must report its result by success or failure
+func (b *breaker) allow() bool {
+	if b.threshold < 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	}
+	return false // the probe is on the way
+}
+
+// success records a write reaching the database, and closes the breaker
+func (b *breaker) success() {
+	if b.threshold < 0 {
+		return
+	}
+	b.mu.Lock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+// failure records a write failed because the database is unavailable, and opens the breaker
+// if there are too many of them. It returns false if the breaker is disabled
+func (b *breaker) failure() bool {
+	if b.threshold < 0 {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+	return true
+}
+
+// closed returns whether the database is believed to be available
+func (b *breaker) closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed
+}
@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"log"
+	"time"
+)
+
+// ErrNoCatalog is returned by Tables if the backend does not record the tables
+var ErrNoCatalog = errors.New("logcrane: the backend has no catalog")
+
+// catalogEntry returns the catalog entry of the table of the log rolled at the time
+func (c *LogCrane) catalogEntry(cLog def.Logger, tableFullName string, rollType int32, t time.Time) def.TableEntry {
+	start, end := utils.GetPeriod(rollType, t)
+	hash, columns := utils.GetSchema(cLog)
+	return def.TableEntry{
+		LogTable:      cLog.TableName(),
+		TableFullName: tableFullName,
+		Roll:          rollType,
+		PeriodStart:   start,
+		PeriodEnd:     end,
+		SchemaHash:    hash,
+		Columns:       columns,
+		CreatedAt:     time.Now().Unix(),
+	}
+}
+
+// catalog returns the catalog of the backend, or nil if it has none
+func (c *LogCrane) catalog() def.Catalog {
+	catalog, _ := c.Backend().(def.Catalog)
+	return catalog
+}
+
+// saveCatalog records the table in the catalog, the errors are only printed
+func (c *LogCrane) saveCatalog(catalog def.Catalog, entry def.TableEntry) {
+	if err := catalog.SaveTable(entry); err != nil {
+		log.Println("Save catalog of " + entry.TableFullName + " error!")
+		log.Println(err)
+	}
+}
+
+// Tables returns the tables created for the logs of tableName whose periods overlap [from, to),
+// ordered by their periods. It returns ErrNoCatalog if the backend does not record the tables
+func (c *LogCrane) Tables(tableName string, from, to time.Time) ([]def.TableEntry, error) {
+	catalog := c.catalog()
+	if catalog == nil {
+		return nil, ErrNoCatalog
+	}
+	return catalog.Tables(tableName, from.Unix(), to.Unix())
+}
@@ -3,9 +3,10 @@ package core
 
 import (
 	"container/list"
-	"database/sql"
+	"context"
 	"github.com/cranewill/logcrane/def"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/cranewill/logcrane/utils"
+	"github.com/cranewill/logcrane/wal"
 	"log"
 	"strconv"
 	"sync"
@@ -13,102 +14,381 @@ import (
 	"time"
 )
 
-var craneChan chan def.Logger
+type LogCrane struct {
+	Config      *def.Config                // the configuration
+	ServerId    string                     // server id
+	Workers     map[string]*Worker         // tableName -> worker, guarded by mu
+	counters    map[string]*def.LogCounter // tableName -> counter, guarded by mu
+	samples     map[string]def.Logger      // tableName -> a log of the table, guarded by mu
+	Wgp         *sync.WaitGroup            // waits for the end of every worker goroutine
+	logChannels map[string]chan task       // tableName -> channel. every channel deal one type of cLog, guarded by mu
+	backend     def.Backend                // the storage where logs are saved, guarded by mu
+	craneChan   chan task                  // every cLog is put here first, and lifted into its own channel
+	lifting     *task                      // the task being lifted when the log system stops
+	inLift      int32                      // 1 while Lift holds a log taken from the crane channel
+	spiller     *spiller                   // writes the logs when the buffer is full or the database is unavailable
+	breaker     *breaker                   // detects whether the database is unavailable
+	wal         *wal.Log                   // the write-ahead log, nil if it is disabled
+	deadSink    def.Backend                // the sink of def.DeadLetterFile, guarded by mu
+	replaying   []wal.Record               // the logs left in the write-ahead log by the last run
+	status      int32                      // def.StatusStopped, def.StatusConnecting or def.StatusLive
+	ctx         context.Context            // canceled when the log system stops
+	cancel      context.CancelFunc
+	writes      context.Context // the context of the writes of the workers, canceled when Stop gives up waiting for them
+	stopWrites  context.CancelFunc
+	stopped     chan struct{}  // closed when Stop returns
+	loops       sync.WaitGroup // waits for the end of Lift, Connect, Replay, Backfill, Janitor and replayWal
+	ingress     sync.RWMutex   // held for reading while the logs are put into the channels, Stop closes it before draining them
+	mu          sync.RWMutex
+}
 
-func init() {
-	def.ChannelBuffer = 10000
-	def.BatchNum = 100
-	craneChan = make(chan def.Logger, def.ChannelBuffer)
+// task is carried by the channels, it is either a log to save or a signal to flush
+type task struct {
+	cLog  def.Logger
+	done  chan error // receives the result of saving cLog, nil if nobody waits for it
+	seq   uint64     // the sequence number of cLog in the write-ahead log, 0 if it is not written ahead
+	flush *flushSignal
 }
 
-type LogCrane struct {
-	MysqlDb     *sql.DB                    // the mysql database handle
-	Running     bool                       // is running
-	ServerId    string                     // server id
-	LogChannels map[string]chan def.Logger // tableName -> channel. every channel deal one type of cLog
-	Workers     map[string]*Worker         // tableName -> worker
-	Wgp         *sync.WaitGroup
+// finish sends the result of saving the log to the one waiting for it
+func (t task) finish(err error) {
+	if t.done != nil {
+		t.done <- err
+	}
+}
+
+// NewLogCrane initializes a LogCrane with the configuration, the defaults
+// of the configuration should have been set
+func NewLogCrane(cfg *def.Config) *LogCrane {
+	ctx, cancel := context.WithCancel(context.Background())
+	writes, stopWrites := context.WithCancel(context.Background())
+	c := &LogCrane{
+		Config:      cfg,
+		ServerId:    cfg.ServerId,
+		Workers:     make(map[string]*Worker),
+		counters:    make(map[string]*def.LogCounter),
+		samples:     make(map[string]def.Logger),
+		Wgp:         &sync.WaitGroup{},
+		logChannels: make(map[string]chan task),
+		craneChan:   make(chan task, cfg.ChannelBuffer),
+		spiller:     newSpiller(cfg.SpillDir),
+		breaker:     newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown),
+		ctx:         ctx,
+		cancel:      cancel,
+		writes:      writes,
+		stopWrites:  stopWrites,
+		stopped:     make(chan struct{}),
+	}
+	for _, cLog := range cfg.Logs { // the files left by the last run can be decoded before the logs come
+		c.spiller.register(cLog)
+		c.samples[cLog.TableName()] = cLog
+	}
+	return c
+}
+
+// Start starts lifting the logs into the backend. If the backend is nil, the logs are buffered
+// and the backend is opened by open every Config.RetryInterval until it succeeds.
+// if Config.MonitorTick > 0, a log monitor will be started and it prints monitor log every tick.
+// If any table spills the logs, the spilled logs are replayed every Config.FlushInterval, and
+// the logs deferred when the database is unavailable are backfilled every Config.FlushInterval.
+// The expired tables are cleaned every Config.JanitorInterval, see Clean
+func (c *LogCrane) Start(b def.Backend, open func() (def.Backend, error)) {
+	c.loops.Add(1)
+	if b != nil {
+		c.mu.Lock()
+		c.backend = b
+		c.mu.Unlock()
+		c.SetStatus(def.StatusLive)
+		go func() {
+			defer c.loops.Done()
+			c.Lift()
+		}()
+	} else {
+		c.SetStatus(def.StatusConnecting)
+		go func() {
+			defer c.loops.Done()
+			c.Connect(open, c.Config.RetryInterval)
+		}()
+	}
+	if len(c.replaying) > 0 {
+		c.loops.Add(1)
+		go func() {
+			defer c.loops.Done()
+			c.replayWal()
+		}()
+	}
+	if c.Config.Spilling() {
+		c.loops.Add(1)
+		go func() {
+			defer c.loops.Done()
+			c.Replay(c.Config.FlushInterval)
+		}()
+	}
+	if c.Config.BreakerThreshold >= 0 {
+		c.loops.Add(1)
+		go func() {
+			defer c.loops.Done()
+			c.Backfill(c.Config.FlushInterval)
+		}()
+	}
+	c.loops.Add(1)
+	go func() {
+		defer c.loops.Done()
+		c.Janitor(c.Config.JanitorInterval)
+	}()
+	if c.Config.MonitorTick > 0 {
+		go c.Monitor(c.Config.MonitorTick)
+	}
+}
+
+// Status returns whether the logs are being saved, see def.StatusLive
+func (c *LogCrane) Status() int32 {
+	if c == nil {
+		return def.StatusStopped
+	}
+	return atomic.LoadInt32(&c.status)
+}
+
+// SetStatus sets the status of the log system
+func (c *LogCrane) SetStatus(status int32) {
+	atomic.StoreInt32(&c.status, status)
+}
+
+// Running returns whether the log system accepts logs
+func (c *LogCrane) Running() bool {
+	return c.Status() != def.StatusStopped
+}
+
+// enqueue puts the task into the crane channel. It returns ErrStopped if the log system
+// stops first, and ctx.Err() if ctx is done first
+func (c *LogCrane) enqueue(ctx context.Context, t task) error {
+	c.ingress.RLock()
+	defer c.ingress.RUnlock()
+	if !c.Running() { // checked again under the lock, Stop may have drained the channels
+		return ErrStopped
+	}
+	select {
+	case c.craneChan <- t:
+		return nil
+	case <-c.ctx.Done():
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Backend returns the storage where logs are saved, it is nil before connected
+func (c *LogCrane) Backend() def.Backend {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.backend
+}
+
+// Connect opens the backend after every interval until it succeeds or the log system stops,
+// then it starts lifting the logs. The logs executed before the backend is connected are
+// buffered in the crane channel
+func (c *LogCrane) Connect(open func() (def.Backend, error), interval time.Duration) {
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		b, err := open()
+		if err != nil {
+			log.Println("Connect log database error, retry in ", interval)
+			log.Println(err)
+			continue
+		}
+		c.mu.Lock()
+		if c.ctx.Err() != nil { // stopped while opening
+			c.mu.Unlock()
+			b.Close()
+			return
+		}
+		c.backend = b
+		c.SetStatus(def.StatusLive)
+		c.mu.Unlock()
+		log.Println("Log database connected!")
+		c.Lift()
+		return
+	}
 }
 
-// Execute throws the logs and put them into a channel to avoid from concurrent panic
+// Execute throws the logs and put them into a channel to avoid from concurrent panic.
+// If the channel is full, the log is dealt by the overflow policy of its table, see def.OverflowBlock
 func (c *LogCrane) Execute(cLog def.Logger) {
 	if c == nil {
 		log.Println("Log system not init!")
 		return
 	}
-	if !c.Running {
+	if !c.Running() {
 		log.Println("Log system not running!")
 		return
 	}
-	craneChan <- cLog
+	c.execute(cLog, true)
 }
 
-// Lift gives every cLog to its own channel waiting for saving
+// TryExecute is like Execute, but it never blocks: the blocking overflow policies drop the log.
+// It returns false if the log is dropped or the log system is not running
+func (c *LogCrane) TryExecute(cLog def.Logger) bool {
+	if !c.Running() {
+		return false
+	}
+	return c.execute(cLog, false)
+}
+
+// ExecuteSync is like Execute, but it blocks until the log has been saved by its worker,
+// and returns the error of the write. The log is still batched with the others,
+// so the call may wait up to the flush interval of the table. ErrDeferred is returned if
+// the log is deferred to the backfill file, ErrStopped if the log system stopped before
+// the log is saved, and ctx.Err() if ctx is done first
+func (c *LogCrane) ExecuteSync(ctx context.Context, cLog def.Logger) error {
+	if !c.Running() {
+		return ErrStopped
+	}
+	if table, exist := c.Config.Tables[cLog.TableName()]; exist && table.Disabled {
+		return nil
+	}
+	seq, ok := c.writeAhead(cLog)
+	if !ok {
+		c.drop(task{cLog: cLog})
+		return ErrDropped
+	}
+	done := make(chan error, 1)
+	if err := c.enqueue(ctx, task{cLog: cLog, done: done, seq: seq}); err != nil {
+		return err
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-c.stopped: // the log may be sent after Stop saved the logs left
+		select {
+		case err := <-done:
+			return err
+		default:
+			return ErrStopped
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Lift gives every cLog to its own channel waiting for saving, and the flush signals
+// to the channels of the tables they flush
 func (c *LogCrane) Lift() {
 	for {
-		if !c.Running {
+		var t task
+		select {
+		case <-c.ctx.Done():
 			return
+		case t = <-c.craneChan:
 		}
-		cLog := <-craneChan
-		tableName := cLog.TableName()
-		if _, exist := c.LogChannels[tableName]; !exist {
-			c.LogChannels[tableName] = make(chan def.Logger, def.ChannelBuffer)
-			c.Workers[tableName] = NewWorker(c, tableName)
-			task := func() {
-				c.Fly(c.Wgp, c.LogChannels[tableName], tableName, cLog.RollType(), cLog.SaveType())
-			}
-			c.Wgp.Add(1)
-			go task()
+		if t.flush != nil {
+			c.liftFlush(t.flush)
+			continue
+		}
+		atomic.StoreInt32(&c.inLift, 1)
+		if c.ServerId != "" {
+			t.cLog = utils.SetServerId(t.cLog, c.ServerId)
 		}
-		if !c.Running {
+		logChan := c.getLogChannel(t.cLog)
+		select {
+		case <-c.ctx.Done():
+			c.lifting = &t // left to Stop
 			return
+		case logChan <- t:
 		}
-		logChan, _ := c.LogChannels[tableName]
-		logChan <- cLog
+		atomic.StoreInt32(&c.inLift, 0)
 	}
 }
 
+// getLogChannel returns the channel of the cLog's table. If it not exists, the channel
+// and the worker of the table are created, and the worker starts flying
+func (c *LogCrane) getLogChannel(cLog def.Logger) chan task {
+	tableName := cLog.TableName()
+	c.mu.RLock()
+	logChan, exist := c.logChannels[tableName]
+	c.mu.RUnlock()
+	if exist {
+		return logChan
+	}
+	worker := c.addWorker(cLog)
+	c.mu.RLock()
+	logChan = c.logChannels[tableName]
+	c.mu.RUnlock()
+	c.Wgp.Add(1)
+	go c.Fly(c.Wgp, logChan, worker)
+	return logChan
+}
+
+// addWorker creates the channel and the worker of the cLog's table, the save type
+// of the table can be overridden by the configuration
+func (c *LogCrane) addWorker(cLog def.Logger) *Worker {
+	tableName := cLog.TableName()
+	saveType := cLog.SaveType()
+	if table := c.Config.Table(tableName); table.SaveType != 0 {
+		saveType = table.SaveType
+	}
+	worker := NewWorker(c, tableName, cLog.RollType(), saveType)
+	worker.LogCounter = c.counter(tableName)
+	c.spiller.register(cLog)
+	c.mu.Lock()
+	c.logChannels[tableName] = make(chan task, c.Config.ChannelBuffer)
+	c.Workers[tableName] = worker
+	c.samples[tableName] = cLog
+	c.mu.Unlock()
+	return worker
+}
+
 // Fly accepts a logs channel and deals the recording tasks of this logs according to the save type
-func (c *LogCrane) Fly(wgp *sync.WaitGroup, logChan chan def.Logger, tableName string, rollType, saveType int32) {
+func (c *LogCrane) Fly(wgp *sync.WaitGroup, logChan chan task, worker *Worker) {
 	defer wgp.Done()
-	queue := list.New()
-	worker, exist := c.Workers[tableName]
-	if !exist {
-		log.Println("Get worker [", tableName, "] failed!")
+	tableName, saveType := worker.TableName, worker.SaveType
+	if saveType != def.Single && saveType != def.Batch && saveType != def.Update {
+		log.Println("Unknown save type ", saveType, " of ", tableName)
 		return
 	}
+	table := c.Config.Table(tableName)
+	queue := worker.queue // the queue left is saved by Stop
 	for {
-		if !c.Running {
+		var timeout <-chan time.Time
+		if saveType != def.Single {
+			timeout = time.After(table.FlushInterval)
+		}
+		select {
+		case <-c.ctx.Done():
 			log.Println("Stop log worker ", tableName)
-			break
-		}
-		switch saveType {
-		case def.Single:
-			cLog := <-logChan
-			worker.doSingle(cLog, tableName, rollType)
-		case def.Batch:
-			select {
-			case clog := <-logChan:
-				queue.PushBack(clog)
-				if queue.Len() >= def.BatchNum {
-					worker.doBatch(queue, tableName, rollType)
-					queue.Init()
+			return
+		case t := <-logChan:
+			if t.flush != nil {
+				if queue.Len() > 0 {
+					_, err := worker.saveTasks(c.writes, queue)
+					worker.record(err)
+					worker.clear()
 				}
-			case <-time.After(5 * time.Second):
-				worker.doBatch(queue, tableName, rollType)
-				queue.Init()
+				t.flush.done(worker.takeError())
+				continue
 			}
-		case def.Update:
-			select {
-			case clog := <-logChan:
-				queue.PushBack(clog)
-				if queue.Len() >= def.BatchNum {
-					worker.doUpdate(queue, tableName)
-					queue.Init()
-				}
-			case <-time.After(5 * time.Second):
-				worker.doUpdate(queue, tableName)
-				queue.Init()
+			if saveType == def.Single {
+				atomic.StoreInt64(&worker.queued, 1)
+				_, err := worker.saveSlice(c.writes, []task{t})
+				worker.record(err)
+				atomic.StoreInt64(&worker.queued, 0)
+				continue
+			}
+			queue.PushBack(t)
+			atomic.StoreInt64(&worker.queued, int64(queue.Len()))
+			if queue.Len() >= table.BatchSize {
+				_, err := worker.saveTasks(c.writes, queue)
+				worker.record(err)
+				worker.clear()
+			}
+		case <-timeout:
+			if queue.Len() > 0 {
+				_, err := worker.saveTasks(c.writes, queue)
+				worker.record(err)
+				worker.clear()
 			}
 		}
 	}
@@ -118,39 +398,230 @@ func (c *LogCrane) Fly(wgp *sync.WaitGroup, logChan chan def.Logger, tableName s
 // of the log system every tick
 func (c *LogCrane) Monitor(duration time.Duration) {
 	t := time.NewTicker(duration)
-	for range t.C {
-		for tableName, worker := range c.Workers {
-			counter := worker.LogCounter
-			tCount := &counter.TotalCount
-			count := &counter.Count
-			log.Println(tableName + ": New " + strconv.Itoa(int(atomic.LoadUint64(count))) + ", Total " + strconv.Itoa(int(atomic.LoadUint64(tCount))))
-			counter.Count = 0
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.mu.RLock()
+		counters := make(map[string]*def.LogCounter, len(c.counters))
+		for tableName, counter := range c.counters {
+			counters[tableName] = counter
+		}
+		c.mu.RUnlock()
+		if !c.breaker.closed() {
+			log.Println("Log database unavailable, logs are deferred to " + c.Config.SpillDir)
+		}
+		for tableName, counter := range counters {
+			count := atomic.SwapUint64(&counter.Count, 0)
+			tCount := atomic.LoadUint64(&counter.TotalCount)
+			dropped := atomic.LoadUint64(&counter.Dropped)
+			spilled := atomic.LoadUint64(&counter.Spilled)
+			dead := atomic.LoadUint64(&counter.Dead)
+			deferred := atomic.LoadUint64(&counter.Deferred)
+			backfilled := atomic.LoadUint64(&counter.Backfilled)
+			log.Println(tableName + ": New " + strconv.FormatUint(count, 10) + ", Total " + strconv.FormatUint(tCount, 10) +
+				", Dropped " + strconv.FormatUint(dropped, 10) + ", Spilled " + strconv.FormatUint(spilled, 10) +
+				", Dead " + strconv.FormatUint(dead, 10) + ", Backfill " + strconv.FormatUint(backfilled, 10) +
+				"/" + strconv.FormatUint(deferred, 10))
 		}
 	}
 }
 
-// Stop ends all the goroutine and finish all the logs left,
-// use batch insert to finish the logs
+// Stop ends all the goroutine and finish all the logs left without deadline
 func (c *LogCrane) Stop() {
-	c.Running = false
-	c.Wgp.Wait() // wait for the end of every worker goroutine
-	for tableName, logChan := range c.LogChannels {
-		size := len(logChan)
-		if size <= 0 {
-			continue
+	c.StopContext(context.Background())
+}
+
+// StopContext stops accepting logs, ends all the goroutine and saves all the logs left
+// in the channels and the batch queues according to their save types, then closes the backend.
+// If ctx is done before all the logs are saved, the logs left are lost and ctx.Err() is returned,
+// the goroutine still saving are left to close the backend when they end.
+// It returns how many logs are saved, and how many logs are lost because of failed writes,
+// the deadline, or the database never connected. The logs deferred to the backfill files because
+// the database is unavailable are neither, they are counted by Counters
+func (c *LogCrane) StopContext(ctx context.Context) (flushed, lost int, err error) {
+	c.mu.Lock()
+	status := c.Status()
+	c.SetStatus(def.StatusStopped)
+	c.cancel()
+	c.mu.Unlock()
+	if status == def.StatusStopped {
+		return 0, 0, nil
+	}
+	defer close(c.stopped)
+	go func() { // the writes of the workers go on while Stop waits for them
+		select {
+		case <-ctx.Done():
+		case <-c.stopped:
 		}
-		unFinished := list.New()
-		for i := 0; i < size; i++ {
-			unFinished.PushBack(<-logChan)
+		c.stopWrites()
+	}()
+	c.ingress.Lock() // wait for the logs being executed, no more log is put into the channels
+	c.ingress.Unlock()
+	// wait for the end of lifting so no more worker will be created, then the workers
+	if !wait(ctx, &c.loops) || status == def.StatusLive && !wait(ctx, c.Wgp) {
+		lost = c.unsaved()
+		log.Println("Log system stop timeout, ", lost, " logs lost")
+		go func() {
+			c.loops.Wait()
+			c.Wgp.Wait()
+			c.spiller.close()
+			c.closeBackend()
+			c.closeWal()
+			c.ReleaseDirs()
+		}()
+		return 0, lost, ctx.Err()
+	}
+	defer c.ReleaseDirs()
+	defer c.closeWal()
+	defer c.spiller.close() // after the logs left are saved, they may be deferred to the backfill files
+	if status != def.StatusLive {
+		for size := len(c.craneChan); size > 0; size-- {
+			if t := <-c.craneChan; t.flush != nil {
+				t.flush.done(ErrStopped)
+			} else {
+				t.finish(ErrStopped)
+				lost++
+			}
 		}
-		cLog := unFinished.Front().Value.(def.Logger)
-		rollType := cLog.RollType()
-		worker, exist := c.Workers[tableName]
-		if !exist {
-			log.Println("Get worker [", tableName, "] failed!")
+		log.Println("Log database not connected, ", lost, " buffered logs lost")
+		return 0, lost, nil
+	}
+	pending, signals := c.pending()
+	deferred := 0
+	for tableName, unFinished := range pending {
+		if unFinished.Len() == 0 {
 			continue
 		}
-		log.Println("Clean ", size, " logs ", tableName, " when system stop ...")
-		worker.doBatch(unFinished, tableName, rollType)
+		worker := c.Workers[tableName]
+		batchSize := c.Config.Table(tableName).BatchSize
+		log.Println("Clean ", unFinished.Len(), " logs ", tableName, " when system stop ...")
+		for unFinished.Len() > 0 {
+			if ctx.Err() != nil {
+				lost += unFinished.Len()
+				err = ctx.Err()
+				for e := unFinished.Front(); e != nil; e = e.Next() {
+					e.Value.(task).finish(ErrStopped)
+				}
+				break
+			}
+			batch := list.New()
+			for batch.Len() < batchSize && unFinished.Len() > 0 {
+				batch.PushBack(unFinished.Remove(unFinished.Front()))
+			}
+			before := atomic.LoadUint64(&c.counter(tableName).Deferred)
+			failed, _ := worker.saveTasks(ctx, batch)
+			n := int(atomic.LoadUint64(&c.counter(tableName).Deferred) - before)
+			deferred += n
+			lost += failed
+			flushed += batch.Len() - failed - n
+		}
+	}
+	if deferred > 0 {
+		log.Println(deferred, " logs deferred to the backfill files when system stop")
+	}
+	c.closeBackend()
+	var flushErr error
+	if lost > 0 {
+		log.Println("Log system stopped, ", flushed, " logs saved, ", lost, " logs lost")
+		flushErr = ErrStopped
+	}
+	for _, signal := range signals {
+		signal.done(flushErr)
+	}
+	return flushed, lost, err
+}
+
+// wait waits for wg, it returns false if ctx is done first
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// unsaved counts the logs left in the channels and the batch queues while the goroutine
+// have not ended, the flush signals in the channels are counted too
+func (c *LogCrane) unsaved() int {
+	n := len(c.craneChan) + int(atomic.LoadInt32(&c.inLift))
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for tableName, logChan := range c.logChannels {
+		n += len(logChan)
+		if worker, exist := c.Workers[tableName]; exist {
+			n += int(atomic.LoadInt64(&worker.queued))
+		}
+	}
+	return n
+}
+
+// closeBackend closes the backend and the dead letter sink
+func (c *LogCrane) closeBackend() {
+	c.mu.RLock()
+	b, deadSink := c.backend, c.deadSink
+	c.mu.RUnlock()
+	if b != nil {
+		if err := b.Close(); err != nil {
+			log.Println("Close backend error!")
+			log.Println(err)
+		}
+	}
+	if deadSink != nil {
+		if err := deadSink.Close(); err != nil {
+			log.Println("Close dead letter sink error!")
+			log.Println(err)
+		}
+	}
+}
+
+// pending collects the tasks of the logs left in the batch queues and the channels after all the
+// goroutine ended, grouped by table name and in the order they were executed.
+// The flush signals left are returned too
+func (c *LogCrane) pending() (map[string]*list.List, []*flushSignal) {
+	pending := make(map[string]*list.List)
+	var signals []*flushSignal
+	add := func(t task) {
+		if t.flush != nil {
+			signals = append(signals, t.flush)
+			return
+		}
+		tableName := t.cLog.TableName()
+		if _, exist := c.Workers[tableName]; !exist {
+			c.addWorker(t.cLog)
+		}
+		if _, exist := pending[tableName]; !exist {
+			pending[tableName] = list.New()
+		}
+		pending[tableName].PushBack(t)
+	}
+	for tableName, worker := range c.Workers {
+		pending[tableName] = worker.queue
+		worker.queue = list.New()
+		logChan := c.logChannels[tableName]
+		for size := len(logChan); size > 0; size-- {
+			add(<-logChan)
+		}
+	}
+	if c.lifting != nil {
+		add(*c.lifting)
+		c.lifting = nil
+	}
+	for size := len(c.craneChan); size > 0; size-- {
+		t := <-c.craneChan
+		if t.cLog != nil && c.ServerId != "" {
+			t.cLog = utils.SetServerId(t.cLog, c.ServerId)
+		}
+		add(t)
 	}
+	return pending, signals
 }
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+	"sync"
+)
+
+// ErrDirInUse is returned when a directory of the instance is used by another running instance
+var ErrDirInUse = errors.New("logcrane: the directory is used by another instance")
+
+var (
+	dirsMu sync.Mutex
+	dirs   = make(map[string]*LogCrane) // absolute directory -> the running instance using it
+)
+
+// ClaimDirs reserves the spill, dead letter, export and write-ahead log directories for the
+// instance, the instances sharing a directory would take the files of each other. It returns
+// ErrDirInUse if any of them is used by another running instance. They are released when it stops
+func (c *LogCrane) ClaimDirs() error {
+	claimed := make([]string, 0, 4)
+	for _, dir := range []string{c.Config.SpillDir, c.Config.DeadLetterDir, c.Config.ExportDir, c.Config.WalDir} {
+		if dir == "" {
+			continue
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		claimed = append(claimed, abs)
+	}
+	dirsMu.Lock()
+	defer dirsMu.Unlock()
+	for _, dir := range claimed {
+		if owner, exist := dirs[dir]; exist && owner != c {
+			log.Println("Directory ", dir, " is used by log system ", owner.ServerId)
+			return ErrDirInUse
+		}
+	}
+	for _, dir := range claimed {
+		dirs[dir] = c
+	}
+	return nil
+}
+
+// ReleaseDirs releases the directories claimed by the instance
+func (c *LogCrane) ReleaseDirs() {
+	dirsMu.Lock()
+	defer dirsMu.Unlock()
+	for dir, owner := range dirs {
+		if owner == c {
+			delete(dirs, dir)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrStopped is returned when the log system stopped before the logs are saved
+var ErrStopped = errors.New("log system stopped")
+
+// Errors aggregates the errors of several tables
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// flushSignal follows the logs through the channels, every worker receiving it
+// saves its queue and reports the errors
+type flushSignal struct {
+	tableName string // the table to flush, or every table if empty
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	errs      Errors
+}
+
+// done marks one receiver of the signal done
+func (f *flushSignal) done(err error) {
+	if err != nil {
+		f.mu.Lock()
+		f.errs = append(f.errs, err)
+		f.mu.Unlock()
+	}
+	f.wg.Done()
+}
+
+// err returns the aggregated error after every receiver is done
+func (f *flushSignal) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.errs) == 0 {
+		return nil
+	}
+	return f.errs
+}
+
+// Flush blocks until every log executed before the call has been saved or failed,
+// and returns the errors of the failed writes since the last flush as Errors, with ErrDeferred
+// for the tables whose logs are only deferred to the backfill files. It returns ctx.Err() if ctx is done first, the logs are still saved later
+func (c *LogCrane) Flush(ctx context.Context) error {
+	return c.flush(ctx, "")
+}
+
+// FlushTable is like Flush, but only flushes the logs of the table
+func (c *LogCrane) FlushTable(ctx context.Context, tableName string) error {
+	return c.flush(ctx, tableName)
+}
+
+func (c *LogCrane) flush(ctx context.Context, tableName string) error {
+	if !c.Running() {
+		return ErrStopped
+	}
+	signal := &flushSignal{tableName: tableName}
+	signal.wg.Add(1) // done by Lift
+	if err := c.enqueue(ctx, task{flush: signal}); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		signal.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return signal.err()
+	case <-c.stopped: // the signal may be sent after Stop saved the logs left
+		select {
+		case <-done:
+			return signal.err()
+		default:
+			return ErrStopped
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// liftFlush gives the flush signal to the channels of the tables it flushes
+func (c *LogCrane) liftFlush(signal *flushSignal) {
+	defer signal.done(nil)
+	c.mu.RLock()
+	logChans := make([]chan task, 0, len(c.logChannels))
+	for tableName, logChan := range c.logChannels {
+		if signal.tableName == "" || signal.tableName == tableName {
+			logChans = append(logChans, logChan)
+		}
+	}
+	c.mu.RUnlock()
+	for _, logChan := range logChans {
+		signal.wg.Add(1)
+		select {
+		case logChan <- task{flush: signal}:
+		case <-c.ctx.Done():
+			signal.done(ErrStopped)
+			return
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package core
+
+import (
+	"errors"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ErrNoRemover is returned by Clean if the backend can not remove tables
+var ErrNoRemover = errors.New("logcrane: the backend can not remove tables")
+
+// Janitor cleans the expired tables every interval until the log system stops,
+// with Config.RetentionDryRun. It does nothing if the backend can not remove tables
+func (c *LogCrane) Janitor(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if c.Status() == def.StatusLive {
+			if _, err := c.Clean(c.Config.RetentionDryRun); err != nil && err != ErrNoRemover {
+				log.Println("Clean expired tables error!")
+				log.Println(err)
+			}
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Clean removes the rolled tables older than the retention of their logs by Config.RetentionAction,
+// and returns their names. The retention is TableConfig.Retention or def.Retainer, the logs without
+// it are kept forever. The expired tables are found in the catalog and by their names, the tables
+// of def.RollTypeCustom are ordered by when they are recorded in the catalog.
+// If dryRun is true, the expired tables are only printed and returned
+func (c *LogCrane) Clean(dryRun bool) ([]string, error) {
+	remover, ok := c.Backend().(def.Remover)
+	if !ok {
+		return nil, ErrNoRemover
+	}
+	c.mu.RLock()
+	tableNames := make([]string, 0, len(c.samples))
+	for tableName := range c.samples {
+		tableNames = append(tableNames, tableName)
+	}
+	c.mu.RUnlock()
+	sort.Strings(tableNames)
+	cleaned := make([]string, 0)
+	for _, tableName := range tableNames {
+		if c.ctx.Err() != nil {
+			break
+		}
+		expired, err := c.expiredTables(remover, tableName, time.Now())
+		if err != nil {
+			return cleaned, err
+		}
+		for _, tableFullName := range expired {
+			if dryRun {
+				log.Println("Retention dry run: table ", tableFullName, " is expired")
+			} else if err := c.removeTable(remover, tableFullName); err != nil {
+				return cleaned, err
+			}
+			cleaned = append(cleaned, tableFullName)
+		}
+	}
+	return cleaned, nil
+}
+
+// retention returns how many periods of the tables of the log are kept, 0 if they are kept forever
+func (c *LogCrane) retention(cLog def.Logger) int {
+	keep := c.Config.Table(cLog.TableName()).Retention
+	if keep == 0 {
+		if retainer, ok := cLog.(def.Retainer); ok {
+			keep = retainer.Retention()
+		}
+	}
+	if keep < 0 {
+		return 0
+	}
+	return keep
+}
+
+// expiredTables returns the tables of the log whose periods end before the oldest period kept at now
+func (c *LogCrane) expiredTables(remover def.Remover, tableName string, now time.Time) ([]string, error) {
+	c.mu.RLock()
+	cLog := c.samples[tableName]
+	c.mu.RUnlock()
+	rollType := cLog.RollType()
+	keep := c.retention(cLog)
+	if keep == 0 || rollType == def.Never || c.Config.Table(tableName).SaveType == def.Update {
+		return nil, nil
+	}
+	if rollType == def.RollTypeCustom {
+		return c.expiredCustomTables(tableName, keep)
+	}
+	expiry := utils.GetExpiry(rollType, keep, now)
+	seen := make(map[string]bool)
+	expired := make([]string, 0)
+	if catalog := c.catalog(); catalog != nil {
+		entries, err := catalog.Tables(tableName, 0, expiry)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			seen[entry.TableFullName] = true
+			if entry.PeriodEnd != 0 && entry.PeriodEnd <= expiry {
+				expired = append(expired, entry.TableFullName)
+			}
+		}
+	}
+	// the tables created before the catalog are found by their names
+	names, err := remover.ListTables(tableName)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, tableFullName := range names {
+		if seen[tableFullName] {
+			continue
+		}
+		if t, ok := utils.ParseTableTime(tableName, tableFullName, rollType); ok {
+			if _, end := utils.GetPeriod(rollType, t); end <= expiry {
+				expired = append(expired, tableFullName)
+			}
+		}
+	}
+	return expired, nil
+}
+
+// expiredCustomTables returns the tables of the log of def.RollTypeCustom except the keep latest
+// recorded ones in the catalog, see def.TableEntry.Seq. The tables are only found in the catalog,
+// they are kept if there is no catalog
+func (c *LogCrane) expiredCustomTables(tableName string, keep int) ([]string, error) {
+	catalog := c.catalog()
+	if catalog == nil {
+		return nil, nil
+	}
+	entries, err := catalog.Tables(tableName, 0, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	rolled := make([]def.TableEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.Roll == def.RollTypeCustom && entry.TableFullName != tableName {
+			rolled = append(rolled, entry)
+		}
+	}
+	sort.SliceStable(rolled, func(i, j int) bool { // the tables recorded before the sequence have 0
+		if rolled[i].Seq != rolled[j].Seq {
+			return rolled[i].Seq > rolled[j].Seq
+		}
+		return rolled[i].CreatedAt > rolled[j].CreatedAt
+	})
+	expired := make([]string, 0)
+	for i := keep; i < len(rolled); i++ {
+		expired = append(expired, rolled[i].TableFullName)
+	}
+	return expired, nil
+}
+
+// removeTable drops, archives or exports the expired table by Config.RetentionAction,
+// and forgets it in the catalog
+func (c *LogCrane) removeTable(remover def.Remover, tableFullName string) error {
+	switch c.Config.RetentionAction {
+	case def.RetentionArchive:
+		if c.Config.ArchiveSchema == "" {
+			return errors.New("logcrane: no archive schema for table " + tableFullName)
+		}
+		log.Println("Retention: archive table ", tableFullName, " into ", c.Config.ArchiveSchema)
+		if err := remover.ArchiveTable(tableFullName, c.Config.ArchiveSchema); err != nil {
+			return err
+		}
+	case def.RetentionExport:
+		rows, err := c.exportTable(remover, tableFullName)
+		if err != nil {
+			return err
+		}
+		log.Println("Retention: export ", rows, " rows of table ", tableFullName, " and drop it")
+		if err := remover.DropTable(tableFullName); err != nil {
+			return err
+		}
+	default:
+		log.Println("Retention: drop table ", tableFullName)
+		if err := remover.DropTable(tableFullName); err != nil {
+			return err
+		}
+	}
+	if catalog := c.catalog(); catalog != nil {
+		return catalog.DeleteTable(tableFullName)
+	}
+	return nil
+}
+
+// exportTable writes the rows of the table into <Config.ExportDir>/<tableFullName>.jsonl,
+// the file is rewritten if the last export did not finish
+func (c *LogCrane) exportTable(remover def.Remover, tableFullName string) (int, error) {
+	if err := os.MkdirAll(c.Config.ExportDir, 0755); err != nil {
+		return 0, err
+	}
+	file, err := os.Create(filepath.Join(c.Config.ExportDir, tableFullName+".jsonl"))
+	if err != nil {
+		return 0, err
+	}
+	rows, err := remover.ExportTable(tableFullName, file)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return rows, err
+}
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"errors"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDropped is returned when the log is dropped because the buffer is full
+var ErrDropped = errors.New("log dropped because the buffer is full")
+
+// dropOldestTries is how many times OverflowDropOldest drops a log to make room,
+// other goroutines may take the room first
+const dropOldestTries = 3
+
+// execute puts the log into the crane channel, and deals the log according to the overflow
+// policy of its table if the channel is full. The blocking policies drop the log instead if
+// block is false or the database is not connected. It returns whether the log is accepted
+func (c *LogCrane) execute(cLog def.Logger, block bool) bool {
+	c.ingress.RLock()
+	defer c.ingress.RUnlock()
+	if !c.Running() { // checked again under the lock, Stop may have drained the channels
+		return false
+	}
+	tableName := cLog.TableName()
+	table := c.Config.Table(tableName)
+	if table.Disabled {
+		return true
+	}
+	seq, ok := c.writeAhead(cLog)
+	t := task{cLog: cLog, seq: seq}
+	if !ok {
+		c.drop(t)
+		return false
+	}
+	select {
+	case c.craneChan <- t:
+		return true
+	default:
+	}
+	policy := table.Overflow
+	if policy == def.OverflowBlock || policy == def.OverflowBlockTimeout {
+		if !block || c.Status() != def.StatusLive { // do not block the caller while the database is unreachable
+			policy = def.OverflowDropNewest
+		}
+	}
+	switch policy {
+	case def.OverflowBlock:
+		select {
+		case c.craneChan <- t:
+			return true
+		case <-c.ctx.Done():
+		}
+	case def.OverflowBlockTimeout:
+		timer := time.NewTimer(table.OverflowWait)
+		defer timer.Stop()
+		select {
+		case c.craneChan <- t:
+			return true
+		case <-timer.C:
+		case <-c.ctx.Done():
+		}
+	case def.OverflowDropOldest:
+		if c.dropOldest(t) {
+			return true
+		}
+	case def.OverflowSpill:
+		err := c.spiller.spill(cLog)
+		if err == nil {
+			c.ack(t) // the spill file keeps it
+			atomic.AddUint64(&c.counter(tableName).Spilled, 1)
+			return true
+		}
+		log.Println("Spill log ", tableName, " error!")
+		log.Println(err)
+	}
+	c.drop(t)
+	return false
+}
+
+// dropOldest drops the oldest log waiting in the channel of the log's table, and puts the
+// log into that channel instead of the full crane channel. Only the logs of the same table
+// are dropped, so the log may be saved before the logs of its table still in the crane channel.
+// It returns false if the table has no log to drop
+func (c *LogCrane) dropOldest(t task) bool {
+	tableName := t.cLog.TableName()
+	c.mu.RLock()
+	logChan, exist := c.logChannels[tableName]
+	c.mu.RUnlock()
+	if !exist {
+		return false
+	}
+	if c.ServerId != "" {
+		t.cLog = utils.SetServerId(t.cLog, c.ServerId)
+	}
+	for i := 0; i < dropOldestTries; i++ {
+		select {
+		case old := <-logChan:
+			if old.flush != nil { // the worker still has to receive it
+				go c.requeue(logChan, old)
+			} else {
+				c.drop(old)
+			}
+		default:
+			return false
+		}
+		select {
+		case logChan <- t:
+			return true
+		default:
+		}
+	}
+	return false
+}
+
+// drop counts the dropped log, tells the one waiting for it, and removes it from the
+// write-ahead log. The flush signals are never dropped, they are put back into the crane channel
+func (c *LogCrane) drop(t task) {
+	if t.flush != nil {
+		go c.requeue(c.craneChan, t)
+		return
+	}
+	t.finish(ErrDropped)
+	c.ack(t)
+	atomic.AddUint64(&c.counter(t.cLog.TableName()).Dropped, 1)
+}
+
+// requeue puts the flush signal back into the channel, it is done with ErrStopped
+// if the log system stops first
+func (c *LogCrane) requeue(ch chan task, t task) {
+	c.ingress.RLock()
+	defer c.ingress.RUnlock()
+	if c.Running() {
+		select {
+		case ch <- t:
+			return
+		case <-c.ctx.Done():
+		}
+	}
+	t.flush.done(ErrStopped)
+}
+
+// counter returns the counter of the table, it is created if not exists
+func (c *LogCrane) counter(tableName string) *def.LogCounter {
+	c.mu.RLock()
+	counter, exist := c.counters[tableName]
+	c.mu.RUnlock()
+	if exist {
+		return counter
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if counter, exist = c.counters[tableName]; !exist {
+		counter = &def.LogCounter{}
+		c.counters[tableName] = counter
+	}
+	return counter
+}
+
+// Counters returns a snapshot of the counters of every table
+func (c *LogCrane) Counters() map[string]def.LogCounter {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	counters := make(map[string]def.LogCounter, len(c.counters))
+	for tableName, counter := range c.counters {
+		counters[tableName] = def.LogCounter{
+			TotalCount: atomic.LoadUint64(&counter.TotalCount),
+			Count:      atomic.LoadUint64(&counter.Count),
+			Dropped:    atomic.LoadUint64(&counter.Dropped),
+			Spilled:    atomic.LoadUint64(&counter.Spilled),
+			Dead:       atomic.LoadUint64(&counter.Dead),
+			Deferred:   atomic.LoadUint64(&counter.Deferred),
+			Backfilled: atomic.LoadUint64(&counter.Backfilled),
+		}
+	}
+	return counters
+}
+
+// Replay executes the spilled logs again every interval while the crane channel
+// is less than half full
+func (c *LogCrane) Replay(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if c.Status() != def.StatusLive {
+			continue
+		}
+		for _, tableName := range c.spiller.tables(spillExt, replayExt) {
+			if err := c.spiller.replay(tableName, c.replayLog); err != nil {
+				log.Println("Replay spilled logs ", tableName, " error!")
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// replayLog puts the spilled log into the crane channel, it returns false to stop replaying
+func (c *LogCrane) replayLog(cLog def.Logger) bool {
+	if len(c.craneChan) >= cap(c.craneChan)/2 {
+		return false
+	}
+	select {
+	case c.craneChan <- task{cLog: cLog}:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,149 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"github.com/cranewill/logcrane/def"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// saveSlice saves the logs of the tasks and sends the result to the ones waiting for them.
+// A transient error is retried with backoff until Config.WriteRetries or ctx is done, then the
+// logs are deferred to be backfilled unless the circuit breaker is disabled. If the logs fail
+// permanently, they are split in halves and saved again to isolate the bad logs, which go to
+// the dead letter sink. The saved logs are acknowledged in the write-ahead log.
+// It returns how many logs failed, and the last error, see lastError
+func (w *Worker) saveSlice(ctx context.Context, tasks []task) (int, error) {
+	if len(tasks) == 0 {
+		return 0, nil
+	}
+	if !w.Crane.breaker.allow() {
+		return w.Crane.deferTasks(w.TableName, tasks)
+	}
+	err := w.saveRetry(ctx, tasks)
+	if err == nil {
+		w.Crane.breaker.success()
+		w.Crane.ack(tasks...)
+		for _, t := range tasks {
+			t.finish(nil)
+		}
+		return 0, nil
+	}
+	transient := w.Crane.transient(err) || ctx.Err() != nil // the write is canceled
+	if !transient {
+		w.Crane.breaker.success() // the database is available, but the logs are bad
+	} else if w.Crane.breaker.failure() {
+		return w.Crane.deferTasks(w.TableName, tasks)
+	}
+	if len(tasks) > 1 && !transient {
+		half := len(tasks) / 2
+		failed, err1 := w.saveSlice(ctx, tasks[:half])
+		failed2, err2 := w.saveSlice(ctx, tasks[half:])
+		return failed + failed2, lastError(err1, err2)
+	}
+	w.Crane.deadLetter(w.TableName, tasks, err)
+	for _, t := range tasks {
+		t.finish(err)
+	}
+	return len(tasks), err
+}
+
+// saveRetry saves the logs of the tasks within ctx, and retries the transient errors with
+// exponential backoff until ctx is done
+func (w *Worker) saveRetry(ctx context.Context, tasks []task) error {
+	logs := list.New()
+	for _, t := range tasks {
+		logs.PushBack(t.cLog)
+	}
+	cfg := w.Crane.Config
+	backoff := cfg.WriteBackoff
+	for retry := 0; ; retry++ {
+		err := w.save(ctx, logs)
+		if err == nil || retry >= cfg.WriteRetries || !w.Crane.transient(err) {
+			return err
+		}
+		log.Println("Retry saving ", logs.Len(), " logs ", w.TableName, " after ", backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > cfg.WriteMaxBackoff {
+			backoff = cfg.WriteMaxBackoff
+		}
+	}
+}
+
+// transient returns whether saving the logs again may succeed after the error. The errors
+// of the backends which do not classify them are all transient
+func (c *LogCrane) transient(err error) bool {
+	if classifier, ok := c.Backend().(def.Classifier); ok {
+		return classifier.Transient(err)
+	}
+	return true
+}
+
+// SetDeadLetter sets the sink of def.DeadLetterFile, it is closed when the log system stops
+func (c *LogCrane) SetDeadLetter(sink def.Backend) {
+	c.mu.Lock()
+	c.deadSink = sink
+	c.mu.Unlock()
+}
+
+// deadLetter sends the logs failed to save permanently to the sink of Config.DeadLetter
+// with the error, they are printed if there is no sink or it fails. The logs kept by the sink are
+// acknowledged in the write-ahead log. The printed ones are acknowledged too if they failed
+// permanently, saving them again would fail again, and the others are kept to be saved by the next run
+func (c *LogCrane) deadLetter(tableName string, tasks []task, cause error) {
+	atomic.AddUint64(&c.counter(tableName).Dead, uint64(len(tasks)))
+	letters := list.New()
+	for _, t := range tasks {
+		data, err := json.Marshal(t.cLog)
+		if err != nil {
+			data = []byte(err.Error())
+		}
+		letters.PushBack(def.DeadLetter{
+			Base: def.BaseServerLog{
+				ServerId:   c.ServerId,
+				CreateTime: time.Now().Unix(),
+			},
+			LogTable: tableName,
+			Error:    cause.Error(),
+			Log:      string(data),
+		})
+	}
+	var sink def.Backend
+	switch c.Config.DeadLetter {
+	case def.DeadLetterFile:
+		c.mu.RLock()
+		sink = c.deadSink
+		c.mu.RUnlock()
+	case def.DeadLetterTable:
+		sink = c.Backend()
+	}
+	if sink != nil {
+		letter := def.DeadLetter{}
+		err := sink.EnsureTable(letter, letter.TableName(), letter.SaveType(), letter.RollType())
+		if err == nil {
+			err = sink.InsertBatch(letters, letter.TableName())
+		}
+		if err == nil {
+			c.ack(tasks...)
+			return
+		}
+		log.Println("Save dead letters of " + tableName + " error!")
+		log.Println(err)
+	}
+	for e := letters.Front(); e != nil; e = e.Next() {
+		letter := e.Value.(def.DeadLetter)
+		log.Println("Dead letter ", tableName, ": ", letter.Log, ", error: ", letter.Error)
+	}
+	if !c.transient(cause) {
+		c.ack(tasks...)
+	}
+}
@@ -0,0 +1,239 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/cranewill/logcrane/def"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Extensions of the spill files. The logs are appended to the .spill file of the table,
+// which is renamed to .replay when they are executed again. The logs deferred when the
+// database is unavailable are appended to the .backfill file, which is renamed to
+// .backfilling when they are saved again
+const (
+	spillExt       = ".spill"
+	replayExt      = ".replay"
+	backfillExt    = ".backfill"
+	backfillingExt = ".backfilling"
+)
+
+// spiller writes the logs which can not be buffered or saved to the spill files, one file per
+// table and kind and one json object per line. The spill files are kept across restarts, and
+// the logs are decoded into the type of the logs seen by the worker of the table
+type spiller struct {
+	dir   string
+	mu    sync.Mutex
+	files map[string]*os.File     // file name -> the spill file being written
+	types map[string]reflect.Type // tableName -> the type of the logs
+}
+
+// backfillRecord is a line of the .backfill files
+type backfillRecord struct {
+	Time int64           `json:"time"` // the roll time of the log in unix seconds, it decides the rolled table
+	Log  json.RawMessage `json:"log"`
+}
+
+// newSpiller creates a spiller writing into the directory
+func newSpiller(dir string) *spiller {
+	return &spiller{
+		dir:   dir,
+		files: make(map[string]*os.File),
+		types: make(map[string]reflect.Type),
+	}
+}
+
+// register records the type of the logs of the table, so its spill files can be decoded
+func (s *spiller) register(cLog def.Logger) {
+	s.mu.Lock()
+	s.types[cLog.TableName()] = reflect.TypeOf(cLog)
+	s.mu.Unlock()
+}
+
+// spill appends the log to the spill file of its table
+func (s *spiller) spill(cLog def.Logger) error {
+	line, err := json.Marshal(cLog)
+	if err != nil {
+		return err
+	}
+	return s.write(cLog, spillExt, line)
+}
+
+// backfill appends the log with its roll time to the backfill file of its table
+func (s *spiller) backfill(cLog def.Logger, rollTime int64) error {
+	data, err := json.Marshal(cLog)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(backfillRecord{Time: rollTime, Log: data})
+	if err != nil {
+		return err
+	}
+	return s.write(cLog, backfillExt, line)
+}
+
+// write appends the line to the file of the log table with the extension
+func (s *spiller) write(cLog def.Logger, ext string, line []byte) error {
+	tableName := cLog.TableName()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.types[tableName] = reflect.TypeOf(cLog)
+	file, exist := s.files[tableName+ext]
+	if !exist {
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return err
+		}
+		var err error
+		file, err = os.OpenFile(filepath.Join(s.dir, tableName+ext), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.files[tableName+ext] = file
+	}
+	_, err := file.Write(append(line, '\n'))
+	return err
+}
+
+// sync commits the file of the log table with the extension to the disk, if it is open
+func (s *spiller) sync(tableName, ext string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if file, exist := s.files[tableName+ext]; exist {
+		return file.Sync()
+	}
+	return nil
+}
+
+// tables returns the tables which have the files of ext or doingExt to consume and whose
+// log types are known
+func (s *spiller) tables(ext, doingExt string) []string {
+	names, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tables := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, info := range names {
+		fileExt := filepath.Ext(info.Name())
+		tableName := strings.TrimSuffix(info.Name(), fileExt)
+		if (fileExt != ext && fileExt != doingExt) || seen[tableName] {
+			continue
+		}
+		if _, exist := s.types[tableName]; exist {
+			seen[tableName] = true
+			tables = append(tables, tableName)
+		}
+	}
+	return tables
+}
+
+// replay executes the spilled logs of the table again by execute in the order they were spilled.
+// If execute fails, the logs left are kept in the replay file
+func (s *spiller) replay(tableName string, execute func(def.Logger) bool) error {
+	typ := s.logType(tableName)
+	return s.consume(tableName, spillExt, replayExt, 1, func(lines [][]byte) int {
+		cLog, err := decodeLog(typ, lines[0])
+		if err != nil {
+			log.Println("Decode spilled log ", tableName, " error!")
+			log.Println(err)
+			return 1
+		}
+		if !execute(cLog) {
+			return 0
+		}
+		return 1
+	})
+}
+
+// logType returns the type of the logs of the table
+func (s *spiller) logType(tableName string) reflect.Type {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.types[tableName]
+}
+
+// consume renames the file of the table from ext to doingExt, and passes its lines to handle in
+// chunks of at most size lines in order. handle returns how many lines at the head of the chunk
+// are done, if it returns 0 the lines left are kept in the doingExt file and consumed first next time
+func (s *spiller) consume(tableName, ext, doingExt string, size int, handle func(lines [][]byte) int) error {
+	doingPath := filepath.Join(s.dir, tableName+doingExt)
+	s.mu.Lock()
+	if file, exist := s.files[tableName+ext]; exist {
+		file.Close()
+		delete(s.files, tableName+ext)
+	}
+	_, err := os.Stat(doingPath)
+	if os.IsNotExist(err) { // the logs left by the last time go first
+		err = os.Rename(filepath.Join(s.dir, tableName+ext), doingPath)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(doingPath)
+	if err != nil {
+		return err
+	}
+	lines := make([][]byte, 0)
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	for len(lines) > 0 {
+		chunk := lines
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		done := handle(chunk)
+		if done <= 0 {
+			return ioutil.WriteFile(doingPath, append(bytes.Join(lines, []byte("\n")), '\n'), 0644)
+		}
+		lines = lines[done:]
+	}
+	return os.Remove(doingPath)
+}
+
+// close closes the spill files
+func (s *spiller) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, file := range s.files {
+		if err := file.Close(); err != nil {
+			log.Println("Close spill file ", name, " error!")
+			log.Println(err)
+		}
+		delete(s.files, name)
+	}
+}
+
+// decodeLog decodes the json line into a log of the type
+func decodeLog(typ reflect.Type, line []byte) (def.Logger, error) {
+	var value reflect.Value
+	if typ.Kind() == reflect.Ptr {
+		value = reflect.New(typ.Elem())
+		if err := json.Unmarshal(line, value.Interface()); err != nil {
+			return nil, err
+		}
+	} else {
+		ptr := reflect.New(typ)
+		if err := json.Unmarshal(line, ptr.Interface()); err != nil {
+			return nil, err
+		}
+		value = ptr.Elem()
+	}
+	cLog, ok := value.Interface().(def.Logger)
+	if !ok {
+		return nil, errors.New("spilled log is not a Logger")
+	}
+	return cLog, nil
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"encoding/json"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/wal"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// corruptWalFile is the file in Config.DeadLetterDir keeping the records of the
+// write-ahead log which can not be decoded
+const corruptWalFile = "corrupt_wal.jsonl"
+
+// walRecord is a log written ahead, the log is decoded into the type of the
+// log of the same table in Config.Logs when it is replayed
+type walRecord struct {
+	Table string          `json:"table"`
+	Log   json.RawMessage `json:"log"`
+}
+
+// OpenWal opens the write-ahead log in Config.WalDir if it is set. The logs not saved
+// by the last run are executed again when the log system starts
+func (c *LogCrane) OpenWal() error {
+	if c.Config.WalDir == "" {
+		return nil
+	}
+	w, records, err := wal.Open(c.Config.WalDir, wal.Options{
+		SegmentSize:  c.Config.WalSegment,
+		MaxSize:      c.Config.WalMaxSize,
+		DeleteOldest: c.Config.WalFull == def.WalFullDeleteOldest,
+		Sync:         c.Config.WalSync,
+	})
+	if err != nil {
+		return err
+	}
+	c.wal = w
+	c.replaying = records
+	return nil
+}
+
+// writeAhead appends the log to the write-ahead log, and returns its sequence number,
+// which is 0 if the log is not written ahead. It returns false if the log should be
+// dropped because the write-ahead log is full
+func (c *LogCrane) writeAhead(cLog def.Logger) (uint64, bool) {
+	if c.wal == nil {
+		return 0, true
+	}
+	data, err := json.Marshal(cLog)
+	if err == nil {
+		data, err = json.Marshal(walRecord{Table: cLog.TableName(), Log: data})
+	}
+	var seq uint64
+	if err == nil {
+		seq, err = c.wal.Append(data)
+	}
+	if err == wal.ErrFull {
+		return 0, c.Config.WalFull == def.WalFullSkip
+	}
+	if err != nil { // the log is still saved, but it is not durable
+		log.Println("Write ahead log ", cLog.TableName(), " error!")
+		log.Println(err)
+	}
+	return seq, true
+}
+
+// ack acknowledges the logs of the tasks in the write-ahead log, they are not replayed any more
+func (c *LogCrane) ack(tasks ...task) {
+	if c.wal == nil {
+		return
+	}
+	seqs := make([]uint64, 0, len(tasks))
+	for _, t := range tasks {
+		if t.seq != 0 {
+			seqs = append(seqs, t.seq)
+		}
+	}
+	if len(seqs) == 0 {
+		return
+	}
+	if err := c.wal.Ack(seqs...); err != nil {
+		log.Println("Ack write-ahead log error!")
+		log.Println(err)
+	}
+}
+
+// corruptRecord is a record of the write-ahead log which can not be decoded
+type corruptRecord struct {
+	Seq   uint64 `json:"seq"`
+	Data  string `json:"data"`
+	Error string `json:"error"`
+}
+
+// replayWal executes the logs left in the write-ahead log again. The logs of the tables
+// not in Config.Logs can not be decoded, they are kept for the next start. The records
+// failed to decode are moved to the corruptWalFile, see moveCorrupt
+func (c *LogCrane) replayWal() {
+	records := c.replaying
+	c.replaying = nil
+	types := make(map[string]reflect.Type)
+	for _, cLog := range c.Config.Logs {
+		types[cLog.TableName()] = reflect.TypeOf(cLog)
+	}
+	replayed, unknown := 0, 0
+	var corrupt []corruptRecord
+	defer func() { c.moveCorrupt(corrupt) }()
+	for _, record := range records {
+		r := walRecord{}
+		err := json.Unmarshal(record.Data, &r)
+		var cLog def.Logger
+		if typ, exist := types[r.Table]; err == nil && exist {
+			cLog, err = decodeLog(typ, r.Log)
+		} else if err == nil {
+			unknown++
+			continue
+		}
+		if err != nil {
+			log.Println("Decode write-ahead log ", record.Seq, " error!")
+			log.Println(err)
+			corrupt = append(corrupt, corruptRecord{Seq: record.Seq, Data: string(record.Data), Error: err.Error()})
+			continue
+		}
+		select {
+		case c.craneChan <- task{cLog: cLog, seq: record.Seq}:
+			replayed++
+		case <-c.ctx.Done():
+			return
+		}
+	}
+	log.Println("Replay ", replayed, " logs from the write-ahead log")
+	if unknown > 0 {
+		log.Println(unknown, " logs in the write-ahead log are kept, their tables are not in Config.Logs")
+	}
+}
+
+// moveCorrupt appends the corrupt records to the corruptWalFile and acknowledges them,
+// they are kept in the write-ahead log if the file can not be written
+func (c *LogCrane) moveCorrupt(records []corruptRecord) {
+	if len(records) == 0 {
+		return
+	}
+	file := filepath.Join(c.Config.DeadLetterDir, corruptWalFile)
+	err := os.MkdirAll(c.Config.DeadLetterDir, 0755)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	if err == nil {
+		encoder := json.NewEncoder(f)
+		for _, record := range records {
+			if err = encoder.Encode(record); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Println("Move ", len(records), " corrupt logs of the write-ahead log to ", file, " error!")
+		log.Println(err)
+		return
+	}
+	tasks := make([]task, 0, len(records))
+	for _, record := range records {
+		tasks = append(tasks, task{seq: record.Seq})
+	}
+	c.ack(tasks...)
+	log.Println(len(records), " corrupt logs of the write-ahead log are moved to ", file)
+}
+
+// closeWal closes the write-ahead log, the logs not saved are kept for the next start
+func (c *LogCrane) closeWal() {
+	if c.wal == nil {
+		return
+	}
+	if pending := c.wal.Pending(); pending > 0 {
+		log.Println(pending, " logs not saved are kept in the write-ahead log")
+	}
+	if err := c.wal.Close(); err != nil {
+		log.Println("Close write-ahead log error!")
+		log.Println(err)
+	}
+}
@@ -3,7 +3,6 @@ package core
 import (
 	"container/list"
 	"context"
-	"database/sql"
 	"fmt"
 	"github.com/cranewill/logcrane/def"
 	"github.com/cranewill/logcrane/utils"
@@ -13,186 +12,247 @@ import (
 )
 
 type Worker struct {
-	Crane                 *LogCrane
-	CurrentTable          string
-	TableName             string
-	CreateStatement       string
-	SingleInsertStatement string
-	BatchInsertStatement  string
-	UpdateStatement       string
-	LogCounter            *def.LogCounter
+	Crane      *LogCrane
+	TableName  string
+	RollType   int32
+	SaveType   int32
+	LogCounter *def.LogCounter
+	queue      *list.List                // the tasks of the batch waiting for saving, only used by the goroutine flying the worker
+	queued     int64                     // how many logs are in the queue or being saved, read by Stop if the worker does not end in time
+	failed     int                       // how many writes failed since the last flush
+	deferred   bool                      // whether any logs are deferred since the last flush
+	lastErr    error                     // the last write error since the last flush
+	tables     map[string]def.TableEntry // the ensured tables -> their catalog entries, the ones of the ended periods are forgotten when a new table is ensured
 }
 
 // NewWorker initializes a new worker
-func NewWorker(crane *LogCrane, tableName string) *Worker {
+func NewWorker(crane *LogCrane, tableName string, rollType, saveType int32) *Worker {
 	worker := &Worker{
 		Crane:      crane,
 		TableName:  tableName,
+		RollType:   rollType,
+		SaveType:   saveType,
 		LogCounter: &def.LogCounter{},
+		queue:      list.New(),
+		tables:     make(map[string]def.TableEntry),
 	}
 	return worker
 }
 
+// tableFullName returns the table the log is saved into, rolled by the time of the log,
+// see utils.GetRollTime. The logs of def.Update are never rolled
+func (w *Worker) tableFullName(cLog def.Logger) string {
+	if w.SaveType == def.Update {
+		return w.TableName
+	}
+	return utils.GetTableFullName(cLog, w.RollType)
+}
+
+// save saves a batch of logs of one table within ctx according to the save type of the worker,
+// the logs of def.Single are inserted in batch too unless there is only one
+func (w *Worker) save(ctx context.Context, logs *list.List) error {
+	if logs.Len() == 0 {
+		return nil
+	}
+	tableFullName := w.tableFullName(logs.Front().Value.(def.Logger))
+	switch {
+	case w.SaveType == def.Update:
+		return w.doUpdate(ctx, logs, tableFullName)
+	case w.SaveType == def.Single && logs.Len() == 1:
+		return w.doSingle(ctx, logs.Front().Value.(def.Logger), tableFullName)
+	}
+	return w.doBatch(ctx, logs, tableFullName)
+}
+
+// saveTasks splits the logs of the task list by their tables in order, and saves
+// each part, see saveSlice. It returns how many logs failed, and the last error, see lastError
+func (w *Worker) saveTasks(ctx context.Context, tasks *list.List) (int, error) {
+	parts := make(map[string][]task)
+	order := make([]string, 0, 1)
+	for e := tasks.Front(); e != nil; e = e.Next() {
+		t := e.Value.(task)
+		tableFullName := w.tableFullName(t.cLog)
+		if _, exist := parts[tableFullName]; !exist {
+			order = append(order, tableFullName)
+		}
+		parts[tableFullName] = append(parts[tableFullName], t)
+	}
+	failed := 0
+	var lastErr error
+	for _, tableFullName := range order {
+		n, err := w.saveSlice(ctx, parts[tableFullName])
+		failed += n
+		lastErr = lastError(lastErr, err)
+	}
+	return failed, lastErr
+}
+
+// clear empties the queue after it is saved
+func (w *Worker) clear() {
+	w.queue.Init()
+	atomic.StoreInt64(&w.queued, 0)
+}
+
+// record records the error of a write, which is reported by the next flush
+func (w *Worker) record(err error) {
+	if err == nil {
+		return
+	}
+	if err == ErrDeferred {
+		w.deferred = true
+		return
+	}
+	w.failed++
+	w.lastErr = err
+}
+
+// takeError returns the write errors since the last flush, or ErrDeferred if the logs are
+// only deferred, and clears them
+func (w *Worker) takeError() error {
+	deferred := w.deferred
+	w.deferred = false
+	if w.failed == 0 {
+		if deferred {
+			return ErrDeferred
+		}
+		return nil
+	}
+	err := fmt.Errorf("%s: %d writes failed, last error: %v", w.TableName, w.failed, w.lastErr)
+	w.failed, w.lastErr = 0, nil
+	return err
+}
+
 // doSingle deals one log recording
-func (w *Worker) doSingle(cLog def.Logger, tableName string, rollType int32) {
+func (w *Worker) doSingle(ctx context.Context, cLog def.Logger, tableFullName string) (err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			log.Println(tableName, ":")
-			log.Println(err)
+		if r := recover(); r != nil {
+			log.Println(w.TableName, ":")
+			log.Println(r)
+			err = fmt.Errorf("%s: %v", w.TableName, r)
 		}
 	}()
-	tableFullName := utils.GetTableFullNameByTableName(tableName, rollType)
-	if w.CurrentTable == "" || w.CurrentTable != tableFullName {
-		err := w.checkCreate(cLog, tableName, tableFullName, rollType)
+	if _, exist := w.tables[tableFullName]; !exist {
+		err = w.checkCreate(cLog, tableFullName, w.RollType)
 		if err != nil {
 			log.Println("Create table " + tableFullName + " error!")
 			log.Println(err)
-			return
+			return err
 		}
-		insertStmt := utils.GetInsertSql(cLog) // do insert
-		w.SingleInsertStatement = insertStmt
 	}
-	err := w.doSingleInsert(cLog, tableFullName, w.SingleInsertStatement)
+	if writer, ok := w.Crane.Backend().(def.ContextWriter); ok {
+		logs := list.New()
+		logs.PushBack(cLog)
+		err = writer.InsertBatchContext(ctx, logs, tableFullName)
+	} else {
+		err = w.Crane.Backend().InsertOne(cLog, tableFullName)
+	}
 	if err != nil {
 		log.Println("Insert log " + tableFullName + " error!")
 		log.Println(err)
-		return
+		return err
 	}
 	atomic.AddUint64(&w.LogCounter.Count, 1)
 	atomic.AddUint64(&w.LogCounter.TotalCount, 1)
+	return nil
 }
 
-// doBatch deals a batch of logs
-func (w *Worker) doBatch(logs *list.List, tableName string, rollType int32) {
+// doBatch deals a batch of logs of one table
+func (w *Worker) doBatch(ctx context.Context, logs *list.List, tableFullName string) (err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			log.Println(tableName, ":")
-			log.Println(err)
+		if r := recover(); r != nil {
+			log.Println(w.TableName, ":")
+			log.Println(r)
+			err = fmt.Errorf("%s: %v", w.TableName, r)
 		}
 	}()
-	tableFullName := utils.GetTableFullNameByTableName(tableName, rollType)
-	if (w.CurrentTable == "" || w.CurrentTable != tableFullName) && logs.Len() > 0 {
-		err := w.checkCreate(logs.Front().Value.(def.Logger), tableName, tableFullName, rollType)
+	if _, exist := w.tables[tableFullName]; !exist && logs.Len() > 0 {
+		err = w.checkCreate(logs.Front().Value.(def.Logger), tableFullName, w.RollType)
 		if err != nil {
 			log.Println("Create table " + tableFullName + " error!")
 			log.Println(err)
-			return
+			return err
 		}
-		insertStmt := utils.GetBatchInsertSql(logs.Front().Value.(def.Logger))
-		w.BatchInsertStatement = insertStmt
 	}
-	err := w.doBatchInsert(logs, tableFullName, w.BatchInsertStatement)
+	err = insertBatch(ctx, w.Crane.Backend(), logs, tableFullName)
 	if err != nil {
 		log.Println("Insert log " + tableFullName + " error!")
 		log.Println(err)
-		return
+		return err
 	}
 	atomic.AddUint64(&w.LogCounter.Count, uint64(logs.Len()))
 	atomic.AddUint64(&w.LogCounter.TotalCount, uint64(logs.Len()))
+	return nil
 }
 
 // doUpdate updates logs if they exist in db, insert a new log otherwise
-func (w *Worker) doUpdate(logs *list.List, tableName string) {
+func (w *Worker) doUpdate(ctx context.Context, logs *list.List, tableFullName string) (err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			log.Println(tableName, ":")
-			log.Println(err)
+		if r := recover(); r != nil {
+			log.Println(w.TableName, ":")
+			log.Println(r)
+			err = fmt.Errorf("%s: %v", w.TableName, r)
 		}
 	}()
-	tableFullName := utils.GetTableFullNameByTableName(tableName, def.Never)
-	if (w.CurrentTable == "" || w.CurrentTable != tableFullName) && logs.Len() > 0 {
-		err := w.checkCreate(logs.Front().Value.(def.Logger), tableName, tableFullName, def.Never)
+	if _, exist := w.tables[tableFullName]; !exist && logs.Len() > 0 {
+		err = w.checkCreate(logs.Front().Value.(def.Logger), tableFullName, def.Never)
 		if err != nil {
 			log.Println("Create table " + tableFullName + " error!")
 			log.Println(err)
-			return
+			return err
 		}
-		stmt := utils.GetUpdateSql(logs)
-		w.UpdateStatement = stmt
 	}
-	err := w.doUpdateInsert(logs, tableFullName, w.UpdateStatement)
+	err = upsertBatch(ctx, w.Crane.Backend(), logs, tableFullName)
 	if err != nil {
 		log.Println("Update-Insert log " + tableFullName + " error!")
 		log.Println(err)
-		return
+		return err
 	}
 	atomic.AddUint64(&w.LogCounter.Count, uint64(logs.Len()))
 	atomic.AddUint64(&w.LogCounter.TotalCount, uint64(logs.Len()))
+	return nil
 }
 
-// checkCreate creates the table
-func (w *Worker) checkCreate(cLog def.Logger, tableName, tableFullName string, rollType int32) error {
-	var s string
-	err := w.Crane.MysqlDb.QueryRow("SHOW TABLES LIKE '" + tableFullName + "';").Scan(&s)
-	if err != nil {
-		if err == sql.ErrNoRows { // table not exist in db
-			var createStmt string
-			if w.CreateStatement == "" {
-				createStmt = utils.GetNewCreateSql(cLog)
-				w.CreateStatement = createStmt
-			}
-			stmt := fmt.Sprintf(w.CreateStatement, tableFullName)
-			_, err := w.Crane.MysqlDb.Exec(stmt)
-			log.Println("Create table ", tableFullName)
-			if err != nil {
-				log.Println(stmt)
-				return err
-			}
-		} else {
-			return err
-		}
+// insertBatch inserts the logs through the backend, within ctx if it is a def.ContextWriter
+func insertBatch(ctx context.Context, b def.Backend, logs *list.List, tableFullName string) error {
+	if writer, ok := b.(def.ContextWriter); ok {
+		return writer.InsertBatchContext(ctx, logs, tableFullName)
 	}
-	w.CurrentTable = tableFullName
-	return nil
+	return b.InsertBatch(logs, tableFullName)
 }
 
-// doSingleInsert inserts a single cLog
-func (w *Worker) doSingleInsert(cLog def.Logger, tableFullName, insertStmt string) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	values := utils.GetInsertValues(cLog)
-	preparedStmt := insertStmt + "(" + values + ");"
-	stmt := fmt.Sprintf(preparedStmt, tableFullName)
-	_, err := w.Crane.MysqlDb.ExecContext(ctx, stmt)
-	if err != nil {
-		log.Println(stmt)
-		return err
+// upsertBatch upserts the logs through the backend, within ctx if it is a def.ContextWriter
+func upsertBatch(ctx context.Context, b def.Backend, logs *list.List, tableFullName string) error {
+	if writer, ok := b.(def.ContextWriter); ok {
+		return writer.UpsertBatchContext(ctx, logs, tableFullName)
 	}
-	return nil
+	return b.UpsertBatch(logs, tableFullName)
 }
 
-// doBatchInsert inserts numbers of logs at one time
-func (w *Worker) doBatchInsert(logs *list.List, tableFullName, insertStmt string) error {
-	if logs.Len() == 0 {
-		return nil
-	}
-	for cLog := logs.Front(); cLog != nil; cLog = cLog.Next() {
-		sep := ","
-		if cLog.Next() == nil {
-			sep = ""
-		}
-		insertStmt += "(" + utils.GetInsertValues(cLog.Value.(def.Logger)) + ")" + sep
-	}
-	insertStmt = fmt.Sprintf(insertStmt, tableFullName) + ";"
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	_, err := w.Crane.MysqlDb.ExecContext(ctx, insertStmt)
+// checkCreate creates the table through the backend, and records it in the catalog. The tables
+// of the ended periods are forgotten, and their row estimates are refreshed in the catalog
+func (w *Worker) checkCreate(cLog def.Logger, tableFullName string, rollType int32) error {
+	err := w.Crane.Backend().EnsureTable(cLog, tableFullName, w.SaveType, rollType)
 	if err != nil {
-		log.Println(insertStmt)
 		return err
 	}
-	return nil
-}
-
-// doUpdateInsert executes update
-func (w *Worker) doUpdateInsert(logs *list.List, tableFullName, updateStmt string) error {
-	if logs.Len() == 0 {
-		return nil
+	now := time.Now().Unix()
+	catalog := w.Crane.catalog()
+	for name, entry := range w.tables {
+		if entry.PeriodEnd != 0 && entry.PeriodEnd <= now {
+			if catalog != nil {
+				w.Crane.saveCatalog(catalog, entry)
+			}
+			delete(w.tables, name)
+		}
 	}
-	updateStmt = fmt.Sprintf(updateStmt, tableFullName) + ";"
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	_, err := w.Crane.MysqlDb.ExecContext(ctx, updateStmt)
-	if err != nil {
-		log.Println(updateStmt)
-		return err
+	rollTime := utils.GetRollTime(cLog)
+	entry := def.TableEntry{TableFullName: tableFullName}
+	if catalog != nil {
+		entry = w.Crane.catalogEntry(cLog, tableFullName, rollType, rollTime)
+		w.Crane.saveCatalog(catalog, entry)
+	} else {
+		entry.PeriodStart, entry.PeriodEnd = utils.GetPeriod(rollType, rollTime)
 	}
+	w.tables[tableFullName] = entry
 	return nil
 }
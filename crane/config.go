@@ -0,0 +1,449 @@
+package crane
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/BurntSushi/toml"
+	"github.com/cranewill/logcrane/def"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of the environment variables overriding the configuration
+const EnvPrefix = "LOGCRANE_"
+
+// fileConfig is the configuration in the file. The durations are written like "5s" or "1m30s",
+// the database type and the save types are written as names like "mysql" and "batch"
+type fileConfig struct {
+	ServerId         string                     `json:"server_id" yaml:"server_id" toml:"server_id"`
+	DataBase         string                     `json:"database" yaml:"database" toml:"database"`
+	DSN              string                     `json:"dsn" yaml:"dsn" toml:"dsn"`
+	Host             string                     `json:"host" yaml:"host" toml:"host"`
+	Port             int                        `json:"port" yaml:"port" toml:"port"`
+	User             string                     `json:"user" yaml:"user" toml:"user"`
+	Password         string                     `json:"password" yaml:"password" toml:"password"`
+	DbName           string                     `json:"db_name" yaml:"db_name" toml:"db_name"`
+	Params           map[string]string          `json:"params" yaml:"params" toml:"params"`
+	MaxOpenConns     int                        `json:"max_open_conns" yaml:"max_open_conns" toml:"max_open_conns"`
+	MaxIdleConns     int                        `json:"max_idle_conns" yaml:"max_idle_conns" toml:"max_idle_conns"`
+	ConnMaxLifetime  string                     `json:"conn_max_lifetime" yaml:"conn_max_lifetime" toml:"conn_max_lifetime"`
+	BatchSize        int                        `json:"batch_size" yaml:"batch_size" toml:"batch_size"`
+	FlushInterval    string                     `json:"flush_interval" yaml:"flush_interval" toml:"flush_interval"`
+	ChannelBuffer    int                        `json:"channel_buffer" yaml:"channel_buffer" toml:"channel_buffer"`
+	MonitorTick      string                     `json:"monitor_tick" yaml:"monitor_tick" toml:"monitor_tick"`
+	Overflow         string                     `json:"overflow" yaml:"overflow" toml:"overflow"`
+	OverflowWait     string                     `json:"overflow_wait" yaml:"overflow_wait" toml:"overflow_wait"`
+	SpillDir         string                     `json:"spill_dir" yaml:"spill_dir" toml:"spill_dir"`
+	WalDir           string                     `json:"wal_dir" yaml:"wal_dir" toml:"wal_dir"`
+	WalSegment       int64                      `json:"wal_segment" yaml:"wal_segment" toml:"wal_segment"`
+	WalMaxSize       int64                      `json:"wal_max_size" yaml:"wal_max_size" toml:"wal_max_size"`
+	WalFull          string                     `json:"wal_full" yaml:"wal_full" toml:"wal_full"`
+	WalSync          bool                       `json:"wal_sync" yaml:"wal_sync" toml:"wal_sync"`
+	WriteRetries     int                        `json:"write_retries" yaml:"write_retries" toml:"write_retries"`
+	WriteBackoff     string                     `json:"write_backoff" yaml:"write_backoff" toml:"write_backoff"`
+	WriteMaxBackoff  string                     `json:"write_max_backoff" yaml:"write_max_backoff" toml:"write_max_backoff"`
+	DeadLetter       string                     `json:"dead_letter" yaml:"dead_letter" toml:"dead_letter"`
+	DeadLetterDir    string                     `json:"dead_letter_dir" yaml:"dead_letter_dir" toml:"dead_letter_dir"`
+	BreakerThreshold int                        `json:"breaker_threshold" yaml:"breaker_threshold" toml:"breaker_threshold"`
+	BreakerCooldown  string                     `json:"breaker_cooldown" yaml:"breaker_cooldown" toml:"breaker_cooldown"`
+	AllowDestructive bool                       `json:"allow_destructive" yaml:"allow_destructive" toml:"allow_destructive"`
+	RetentionAction  string                     `json:"retention_action" yaml:"retention_action" toml:"retention_action"`
+	ArchiveSchema    string                     `json:"archive_schema" yaml:"archive_schema" toml:"archive_schema"`
+	ExportDir        string                     `json:"export_dir" yaml:"export_dir" toml:"export_dir"`
+	RetentionDryRun  bool                       `json:"retention_dry_run" yaml:"retention_dry_run" toml:"retention_dry_run"`
+	JanitorInterval  string                     `json:"janitor_interval" yaml:"janitor_interval" toml:"janitor_interval"`
+	Lazy             bool                       `json:"lazy" yaml:"lazy" toml:"lazy"`
+	RetryInterval    string                     `json:"retry_interval" yaml:"retry_interval" toml:"retry_interval"`
+	Tables           map[string]fileTableConfig `json:"tables" yaml:"tables" toml:"tables"`
+}
+
+// fileTableConfig is the overrides of a table in the file
+type fileTableConfig struct {
+	BatchSize     int    `json:"batch_size" yaml:"batch_size" toml:"batch_size"`
+	FlushInterval string `json:"flush_interval" yaml:"flush_interval" toml:"flush_interval"`
+	SaveType      string `json:"save_type" yaml:"save_type" toml:"save_type"`
+	Disabled      bool   `json:"disabled" yaml:"disabled" toml:"disabled"`
+	Overflow      string `json:"overflow" yaml:"overflow" toml:"overflow"`
+	OverflowWait  string `json:"overflow_wait" yaml:"overflow_wait" toml:"overflow_wait"`
+	Retention     int    `json:"retention" yaml:"retention" toml:"retention"`
+}
+
+// dataBaseNames maps the names of the database types in the configuration to the types
+var dataBaseNames = map[string]int32{
+	"mysql":      def.MySql,
+	"mongo":      def.Mongo,
+	"mongodb":    def.Mongo,
+	"sqlite":     def.SQLite,
+	"postgres":   def.Postgres,
+	"postgresql": def.Postgres,
+	"clickhouse": def.ClickHouse,
+	"jsonl":      def.JsonLines,
+	"csv":        def.Csv,
+	"tsv":        def.Tsv,
+}
+
+// saveTypeNames maps the names of the save types in the configuration to the types
+var saveTypeNames = map[string]int32{
+	"single": def.Single,
+	"batch":  def.Batch,
+	"update": def.Update,
+}
+
+// overflowNames maps the names of the overflow policies in the configuration to the policies
+var overflowNames = map[string]int32{
+	"block":         def.OverflowBlock,
+	"block_timeout": def.OverflowBlockTimeout,
+	"drop_newest":   def.OverflowDropNewest,
+	"drop_oldest":   def.OverflowDropOldest,
+	"spill":         def.OverflowSpill,
+}
+
+// walFullNames maps the names of the policies of the full write-ahead log to the policies
+var walFullNames = map[string]int32{
+	"drop":          def.WalFullDrop,
+	"delete_oldest": def.WalFullDeleteOldest,
+	"skip":          def.WalFullSkip,
+}
+
+// deadLetterNames maps the names of the dead letter sinks in the configuration to the sinks
+var deadLetterNames = map[string]int32{
+	"log":   def.DeadLetterLog,
+	"file":  def.DeadLetterFile,
+	"table": def.DeadLetterTable,
+}
+
+// retentionNames maps the names of the retention actions in the configuration to the actions
+var retentionNames = map[string]int32{
+	"drop":    def.RetentionDrop,
+	"archive": def.RetentionArchive,
+	"export":  def.RetentionExport,
+}
+
+// LoadConfig reads the configuration from the file, and overrides it with the environment
+// variables. The file format is chosen by its extension: .yaml/.yml, .json or .toml.
+// If path is empty, the configuration is read from the environment variables only.
+//
+// The environment variables are EnvPrefix followed by the upper case key in the file, like
+// LOGCRANE_DSN, LOGCRANE_BATCH_SIZE and LOGCRANE_FLUSH_INTERVAL. LOGCRANE_PARAMS is a query
+// string like "charset=utf8mb4&loc=Local" merged into the params. The tables are overridden by
+// LOGCRANE_TABLE_<TABLE NAME>_<KEY>, like LOGCRANE_TABLE_LOG_ONLINE_BATCH_SIZE, and
+// LOGCRANE_DISABLED_TABLES is a comma separated list of the disabled table names
+func LoadConfig(path string) (def.Config, error) {
+	fc := fileConfig{}
+	if path != "" {
+		if err := readConfigFile(path, &fc); err != nil {
+			return def.Config{}, err
+		}
+	}
+	if err := readConfigEnv(os.Environ(), &fc); err != nil {
+		return def.Config{}, err
+	}
+	return fc.toConfig()
+}
+
+// readConfigFile decodes the file into fc according to its extension, the unknown keys are refused
+func readConfigFile(path string, fc *fileConfig) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.UnmarshalStrict(content, fc)
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(fc)
+	case ".toml":
+		md, err := toml.Decode(string(content), fc)
+		if err != nil {
+			return err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, 0, len(undecoded))
+			for _, key := range undecoded {
+				keys = append(keys, key.String())
+			}
+			return errors.New("unknown keys " + strings.Join(keys, ", ") + " in " + path)
+		}
+		return nil
+	}
+	return errors.New("unknown config file format " + path)
+}
+
+// readConfigEnv overrides fc with the environment variables, env is a list of "key=value"
+func readConfigEnv(env []string, fc *fileConfig) error {
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv, EnvPrefix) {
+			continue
+		}
+		key, value := strings.ToUpper(kv[len(EnvPrefix):i]), kv[i+1:]
+		var err error
+		switch key {
+		case "SERVER_ID":
+			fc.ServerId = value
+		case "DATABASE":
+			fc.DataBase = value
+		case "DSN":
+			fc.DSN = value
+		case "HOST":
+			fc.Host = value
+		case "PORT":
+			fc.Port, err = strconv.Atoi(value)
+		case "USER":
+			fc.User = value
+		case "PASSWORD":
+			fc.Password = value
+		case "DB_NAME":
+			fc.DbName = value
+		case "PARAMS":
+			var params url.Values
+			if params, err = url.ParseQuery(value); err == nil {
+				if fc.Params == nil {
+					fc.Params = make(map[string]string)
+				}
+				for param := range params {
+					fc.Params[param] = params.Get(param)
+				}
+			}
+		case "MAX_OPEN_CONNS":
+			fc.MaxOpenConns, err = strconv.Atoi(value)
+		case "MAX_IDLE_CONNS":
+			fc.MaxIdleConns, err = strconv.Atoi(value)
+		case "CONN_MAX_LIFETIME":
+			fc.ConnMaxLifetime = value
+		case "BATCH_SIZE":
+			fc.BatchSize, err = strconv.Atoi(value)
+		case "FLUSH_INTERVAL":
+			fc.FlushInterval = value
+		case "CHANNEL_BUFFER":
+			fc.ChannelBuffer, err = strconv.Atoi(value)
+		case "MONITOR_TICK":
+			fc.MonitorTick = value
+		case "OVERFLOW":
+			fc.Overflow = value
+		case "OVERFLOW_WAIT":
+			fc.OverflowWait = value
+		case "SPILL_DIR":
+			fc.SpillDir = value
+		case "WAL_DIR":
+			fc.WalDir = value
+		case "WAL_SEGMENT":
+			fc.WalSegment, err = strconv.ParseInt(value, 10, 64)
+		case "WAL_MAX_SIZE":
+			fc.WalMaxSize, err = strconv.ParseInt(value, 10, 64)
+		case "WAL_FULL":
+			fc.WalFull = value
+		case "WAL_SYNC":
+			fc.WalSync, err = strconv.ParseBool(value)
+		case "WRITE_RETRIES":
+			fc.WriteRetries, err = strconv.Atoi(value)
+		case "WRITE_BACKOFF":
+			fc.WriteBackoff = value
+		case "WRITE_MAX_BACKOFF":
+			fc.WriteMaxBackoff = value
+		case "DEAD_LETTER":
+			fc.DeadLetter = value
+		case "DEAD_LETTER_DIR":
+			fc.DeadLetterDir = value
+		case "BREAKER_THRESHOLD":
+			fc.BreakerThreshold, err = strconv.Atoi(value)
+		case "BREAKER_COOLDOWN":
+			fc.BreakerCooldown = value
+		case "ALLOW_DESTRUCTIVE":
+			fc.AllowDestructive, err = strconv.ParseBool(value)
+		case "RETENTION_ACTION":
+			fc.RetentionAction = value
+		case "ARCHIVE_SCHEMA":
+			fc.ArchiveSchema = value
+		case "EXPORT_DIR":
+			fc.ExportDir = value
+		case "RETENTION_DRY_RUN":
+			fc.RetentionDryRun, err = strconv.ParseBool(value)
+		case "JANITOR_INTERVAL":
+			fc.JanitorInterval = value
+		case "LAZY":
+			fc.Lazy, err = strconv.ParseBool(value)
+		case "RETRY_INTERVAL":
+			fc.RetryInterval = value
+		case "DISABLED_TABLES":
+			for _, tableName := range strings.Split(value, ",") {
+				if tableName = strings.TrimSpace(tableName); tableName != "" {
+					table := fc.table(tableName)
+					table.Disabled = true
+					fc.Tables[tableName] = table
+				}
+			}
+		default:
+			if strings.HasPrefix(key, "TABLE_") {
+				err = readTableEnv(strings.TrimPrefix(key, "TABLE_"), value, fc)
+			}
+		}
+		if err != nil {
+			return errors.New("invalid environment variable " + kv[:i] + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// readTableEnv overrides the table with the environment variable LOGCRANE_TABLE_<key>,
+// the table name is the lower case of key without the suffix
+func readTableEnv(key, value string, fc *fileConfig) error {
+	for _, suffix := range []string{"_BATCH_SIZE", "_FLUSH_INTERVAL", "_SAVE_TYPE", "_DISABLED", "_OVERFLOW", "_OVERFLOW_WAIT", "_RETENTION"} {
+		if !strings.HasSuffix(key, suffix) {
+			continue
+		}
+		tableName := strings.ToLower(strings.TrimSuffix(key, suffix))
+		table := fc.table(tableName)
+		var err error
+		switch suffix {
+		case "_BATCH_SIZE":
+			table.BatchSize, err = strconv.Atoi(value)
+		case "_FLUSH_INTERVAL":
+			table.FlushInterval = value
+		case "_SAVE_TYPE":
+			table.SaveType = value
+		case "_DISABLED":
+			table.Disabled, err = strconv.ParseBool(value)
+		case "_OVERFLOW":
+			table.Overflow = value
+		case "_OVERFLOW_WAIT":
+			table.OverflowWait = value
+		case "_RETENTION":
+			table.Retention, err = strconv.Atoi(value)
+		}
+		fc.Tables[tableName] = table
+		return err
+	}
+	return errors.New("unknown table config")
+}
+
+// table returns the overrides of the table, the tables map is created if it is nil
+func (fc *fileConfig) table(tableName string) fileTableConfig {
+	if fc.Tables == nil {
+		fc.Tables = make(map[string]fileTableConfig)
+	}
+	return fc.Tables[tableName]
+}
+
+// toConfig converts the file configuration into def.Config
+func (fc *fileConfig) toConfig() (def.Config, error) {
+	cfg := def.Config{
+		ServerId:         fc.ServerId,
+		DSN:              fc.DSN,
+		Host:             fc.Host,
+		Port:             fc.Port,
+		User:             fc.User,
+		Password:         fc.Password,
+		DbName:           fc.DbName,
+		Params:           fc.Params,
+		MaxOpenConns:     fc.MaxOpenConns,
+		MaxIdleConns:     fc.MaxIdleConns,
+		BatchSize:        fc.BatchSize,
+		ChannelBuffer:    fc.ChannelBuffer,
+		SpillDir:         fc.SpillDir,
+		WalDir:           fc.WalDir,
+		WalSegment:       fc.WalSegment,
+		WalMaxSize:       fc.WalMaxSize,
+		WalSync:          fc.WalSync,
+		WriteRetries:     fc.WriteRetries,
+		DeadLetterDir:    fc.DeadLetterDir,
+		BreakerThreshold: fc.BreakerThreshold,
+		ArchiveSchema:    fc.ArchiveSchema,
+		ExportDir:        fc.ExportDir,
+		RetentionDryRun:  fc.RetentionDryRun,
+		AllowDestructive: fc.AllowDestructive,
+		Lazy:             fc.Lazy,
+	}
+	var err error
+	if cfg.DataBase, err = parseType(fc.DataBase, dataBaseNames); err != nil {
+		return cfg, errors.New("invalid database: " + err.Error())
+	}
+	if cfg.Overflow, err = parseType(fc.Overflow, overflowNames); err != nil {
+		return cfg, errors.New("invalid overflow: " + err.Error())
+	}
+	if cfg.WalFull, err = parseType(fc.WalFull, walFullNames); err != nil {
+		return cfg, errors.New("invalid wal_full: " + err.Error())
+	}
+	if cfg.RetentionAction, err = parseType(fc.RetentionAction, retentionNames); err != nil {
+		return cfg, errors.New("invalid retention_action: " + err.Error())
+	}
+	if cfg.DeadLetter, err = parseType(fc.DeadLetter, deadLetterNames); err != nil {
+		return cfg, errors.New("invalid dead_letter: " + err.Error())
+	}
+	durations := []struct {
+		name  string
+		value string
+		field *time.Duration
+	}{
+		{"conn_max_lifetime", fc.ConnMaxLifetime, &cfg.ConnMaxLifetime},
+		{"flush_interval", fc.FlushInterval, &cfg.FlushInterval},
+		{"monitor_tick", fc.MonitorTick, &cfg.MonitorTick},
+		{"retry_interval", fc.RetryInterval, &cfg.RetryInterval},
+		{"overflow_wait", fc.OverflowWait, &cfg.OverflowWait},
+		{"write_backoff", fc.WriteBackoff, &cfg.WriteBackoff},
+		{"write_max_backoff", fc.WriteMaxBackoff, &cfg.WriteMaxBackoff},
+		{"breaker_cooldown", fc.BreakerCooldown, &cfg.BreakerCooldown},
+		{"janitor_interval", fc.JanitorInterval, &cfg.JanitorInterval},
+	}
+	for _, d := range durations {
+		if *d.field, err = parseDuration(d.value); err != nil {
+			return cfg, errors.New("invalid " + d.name + ": " + err.Error())
+		}
+	}
+	if len(fc.Tables) > 0 {
+		cfg.Tables = make(map[string]def.TableConfig)
+	}
+	for tableName, ft := range fc.Tables {
+		table := def.TableConfig{
+			BatchSize: ft.BatchSize,
+			Disabled:  ft.Disabled,
+			Retention: ft.Retention,
+		}
+		if table.FlushInterval, err = parseDuration(ft.FlushInterval); err != nil {
+			return cfg, errors.New("invalid flush_interval of table " + tableName + ": " + err.Error())
+		}
+		if table.SaveType, err = parseType(ft.SaveType, saveTypeNames); err != nil {
+			return cfg, errors.New("invalid save_type of table " + tableName + ": " + err.Error())
+		}
+		if table.Overflow, err = parseType(ft.Overflow, overflowNames); err != nil {
+			return cfg, errors.New("invalid overflow of table " + tableName + ": " + err.Error())
+		}
+		if table.OverflowWait, err = parseDuration(ft.OverflowWait); err != nil {
+			return cfg, errors.New("invalid overflow_wait of table " + tableName + ": " + err.Error())
+		}
+		cfg.Tables[tableName] = table
+	}
+	return cfg, nil
+}
+
+// parseDuration parses the duration like "5s", an empty string is 0
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// parseType parses the type written as a name or a number, an empty string is 0
+func parseType(value string, names map[string]int32) (int32, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if typ, exist := names[strings.ToLower(value)]; exist {
+		return typ, nil
+	}
+	typ, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("unknown type " + value)
+	}
+	return int32(typ), nil
+}
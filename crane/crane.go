@@ -2,68 +2,127 @@
 package crane
 
 import (
-	"database/sql"
-	"fmt"
+	"context"
+	"errors"
+	"github.com/cranewill/logcrane/backend"
 	"github.com/cranewill/logcrane/core"
 	"github.com/cranewill/logcrane/def"
 	"log"
 	"sync"
-	"time"
 )
 
+// ErrStarted is returned when starting the log system twice
+var ErrStarted = errors.New("log system already started")
+
 var crane *core.LogCrane
+var craneMu sync.RWMutex // guards crane
 
 // Instance returns the singleton instance of LogCrane
 func Instance() *core.LogCrane {
-	if !crane.Running {
+	craneMu.RLock()
+	defer craneMu.RUnlock()
+	if crane == nil || !crane.Running() {
 		log.Println("Log service not started!")
 		return nil
 	}
 	return crane
 }
 
-// Start starts LogCrane.
-// if monitorTick > 0, a log monitor will be started and it prints monitor log every tick(second)
-func Start(serverId, user, pwd, db string, monitorTick int32) {
+// Status returns the status of the singleton, def.StatusLive means the logs
+// are being saved, def.StatusConnecting means they are buffered until the
+// database is connected
+func Status() int32 {
+	craneMu.RLock()
+	defer craneMu.RUnlock()
+	return crane.Status()
+}
+
+// Start starts the singleton LogCrane with the configuration, see New
+func Start(cfg def.Config) error {
+	craneMu.Lock()
+	defer craneMu.Unlock()
 	if crane != nil {
-		return
+		return ErrStarted
+	}
+	c, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	crane = c
+	return nil
+}
+
+// New creates and starts an independent LogCrane with the configuration, it has its own
+// channels, workers and database connection, and is stopped by its own Stop.
+// It returns the error if the database can not be connected, unless cfg.Lazy is true, and
+// core.ErrDirInUse if its directories are used by another running instance, see def.Config.DataDir.
+// In lazy mode the logs are buffered and the database is reconnected every
+// cfg.RetryInterval until it succeeds, check Status to know whether the logs are being saved.
+// if cfg.MonitorTick > 0, a log monitor will be started and it prints monitor log every tick
+func New(cfg def.Config) (*core.LogCrane, error) {
+	cfg.SetDefaults()
+	open := func() (def.Backend, error) {
+		return backend.Open(&cfg)
+	}
+	b, err := open()
+	if err != nil && !cfg.Lazy {
+		return nil, err
 	}
-	crane = &core.LogCrane{
-		LogChannels: make(map[string]chan def.Logger),
-		ServerId:    serverId,
-		Running:     false,
-		Workers:     make(map[string]*core.Worker),
-		Wgp:         &sync.WaitGroup{},
+	if err != nil {
+		log.Println("Connect log database error, logs are buffered until it is connected")
+		log.Println(err)
+		b = nil
 	}
-	switch def.DataBase {
-	case def.MySql:
-		driver := "%s:%s@/%s"
-		db, err := sql.Open("mysql", fmt.Sprintf(driver, user, pwd, db))
-		if err != nil {
-			panic(err.Error())
+	c := core.NewLogCrane(&cfg)
+	if err := c.ClaimDirs(); err != nil {
+		if b != nil {
+			b.Close()
 		}
-		// test db handle
-		err = db.Ping()
-		if err != nil {
-			panic(err.Error())
+		return nil, err
+	}
+	var sink def.Backend
+	if cfg.DeadLetter == def.DeadLetterFile {
+		if sink, err = backend.OpenJsonl(cfg.DeadLetterDir); err != nil {
+			c.ReleaseDirs()
+			if b != nil {
+				b.Close()
+			}
+			return nil, err
+		}
+	}
+	if err := c.OpenWal(); err != nil {
+		c.ReleaseDirs()
+		if b != nil {
+			b.Close()
+		}
+		if sink != nil {
+			sink.Close()
 		}
-		crane.MysqlDb = db
-	case def.Mongo:
-		// todo ... init mongo
+		return nil, err
 	}
-	crane.Running = true
-	def.ServerId = serverId
-	def.BatchNum = 100
-	go crane.Lift()
-	if monitorTick > 0 {
-		go crane.Monitor(time.Duration(monitorTick) * time.Second)
+	if sink != nil {
+		c.SetDeadLetter(sink)
 	}
-	log.Println("Log System Started!")
+	c.Start(b, open)
+	log.Println("Log System ", cfg.ServerId, " Started!")
+	return c, nil
 }
 
-// Stop stops the log system
+// Stop stops the singleton log system
 func Stop() {
+	StopContext(context.Background())
+}
+
+// StopContext stops the singleton log system, and saves the logs left until ctx is done.
+// It returns how many logs are saved and lost, see core.LogCrane.StopContext
+func StopContext(ctx context.Context) (flushed, lost int, err error) {
+	craneMu.RLock()
+	defer craneMu.RUnlock()
+	if crane == nil {
+		return 0, 0, nil
+	}
 	log.Println("Stop Log System ...")
-	crane.Stop()
+	flushed, lost, err = crane.StopContext(ctx)
 	log.Println("Log System Stopped!")
+	return flushed, lost, err
 }
@@ -0,0 +1,203 @@
+package def
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Default values of the Config
+const (
+	DefaultBatchSize     = 100
+	DefaultFlushInterval = 5 * time.Second
+	DefaultChannelBuffer = 10000
+	DefaultRetryInterval = 5 * time.Second
+	DefaultOverflowWait  = time.Second
+	DefaultSpillDir      = "spill" // under the data directory of the instance, see DataDir
+	DefaultWalSegment    = 64 << 20
+	DefaultWriteRetries  = 3
+	DefaultWriteBackoff  = 100 * time.Millisecond
+	DefaultWriteMaxWait  = 10 * time.Second
+	DefaultDeadLetterDir = "dead_letter"
+	DefaultBreakerLimit  = 3
+	DefaultBreakerWait   = 10 * time.Second
+	DefaultExportDir     = "export"
+	DefaultJanitorTick   = time.Hour
+)
+
+// Config is the configuration of the log system. The database is connected with DSN,
+// or with the dsn built from Host, Port, User, Password, DbName and Params if DSN is empty
+type Config struct {
+	ServerId string // server id, saved in the 'server_id' column
+
+	DataBase int32             // database type registered in backend, MySql by default
+	DSN      string            // data source name passed to the backend
+	Host     string            // database host, the driver default if empty
+	Port     int               // database port, the driver default if 0
+	User     string            // database user
+	Password string            // database password
+	DbName   string            // database name, or the file/directory of the file backends
+	Params   map[string]string // extra dsn parameters, like charset, tls, loc, sslmode
+
+	MaxOpenConns    int           // max open connections of the pool, 0 is unlimited
+	MaxIdleConns    int           // max idle connections of the pool, 0 is the driver default
+	ConnMaxLifetime time.Duration // max lifetime of a connection, 0 is forever
+
+	BatchSize     int           // max logs of one batch insert, DefaultBatchSize if 0
+	FlushInterval time.Duration // max waiting time of a not full batch, DefaultFlushInterval if 0
+	ChannelBuffer int           // buffer size of the log channels, DefaultChannelBuffer if 0
+	MonitorTick   time.Duration // the monitor prints every tick, 0 to disable it
+
+	Overflow     int32         // what Execute does when the buffer is full, OverflowBlock if 0
+	OverflowWait time.Duration // max blocking time of OverflowBlockTimeout, DefaultOverflowWait if 0
+	SpillDir     string        // directory of the spill and backfill files, DefaultSpillDir under DataDir() if empty
+
+	WalDir     string   // directory of the write-ahead log, it is disabled if empty
+	WalSegment int64    // max bytes of a write-ahead log segment, DefaultWalSegment if 0
+	WalMaxSize int64    // max bytes of all the write-ahead log segments, unlimited if 0
+	WalFull    int32    // what Execute does when WalMaxSize is reached, WalFullDrop if 0
+	WalSync    bool     // fsync after every append, otherwise the logs survive process crashes but not machine crashes
+	Logs       []Logger // the kinds of logs replayed from the write-ahead log and cleaned by the janitor, one log of each kind
+
+	WriteRetries    int           // max retries of a transient write error, DefaultWriteRetries if 0, no retry if negative
+	WriteBackoff    time.Duration // waiting time before the first retry, doubled every retry, DefaultWriteBackoff if 0
+	WriteMaxBackoff time.Duration // max waiting time between retries, DefaultWriteMaxWait if 0
+	DeadLetter      int32         // where the logs failed to save permanently go, DeadLetterLog if 0
+	DeadLetterDir   string        // directory of the dead letter files of DeadLetterFile, DefaultDeadLetterDir under DataDir() if empty
+
+	BreakerThreshold int           // consecutive failed writes making the database unavailable, DefaultBreakerLimit if 0, never if negative
+	BreakerCooldown  time.Duration // waiting time before probing the unavailable database, DefaultBreakerWait if 0
+
+	RetentionAction int32         // what the janitor does with the expired tables, RetentionDrop if 0
+	ArchiveSchema   string        // the schema where RetentionArchive moves the expired tables into
+	ExportDir       string        // directory of the files of RetentionExport, DefaultExportDir under DataDir() if empty
+	RetentionDryRun bool          // the janitor only prints the expired tables
+	JanitorInterval time.Duration // interval of looking for the expired tables, DefaultJanitorTick if 0
+
+	AllowDestructive bool // let the schema migration drop the columns not in the logs and change the column types
+
+	Lazy          bool          // start even if the database can not be connected, and buffer the logs until it is connected
+	RetryInterval time.Duration // interval of reconnecting the database in lazy mode, DefaultRetryInterval if 0
+
+	Tables map[string]TableConfig // tableName -> the overrides of the table
+}
+
+// TableConfig overrides the configuration of one kind of logs, keyed by Logger.TableName()
+type TableConfig struct {
+	BatchSize     int           // max logs of one batch insert, Config.BatchSize if 0
+	FlushInterval time.Duration // max waiting time of a not full batch, Config.FlushInterval if 0
+	SaveType      int32         // overrides Logger.SaveType() if not 0
+	Disabled      bool          // the logs of the table are dropped
+	Overflow      int32         // what Execute does when the buffer is full, Config.Overflow if 0
+	OverflowWait  time.Duration // max blocking time of OverflowBlockTimeout, Config.OverflowWait if 0
+	Retention     int           // how many periods of rolled tables are kept, Retainer.Retention() if 0, forever if negative
+}
+
+// SetDefaults sets the default values of the fields not configured
+func (cfg *Config) SetDefaults() {
+	if cfg.DataBase == 0 {
+		cfg.DataBase = MySql
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	if cfg.ChannelBuffer <= 0 {
+		cfg.ChannelBuffer = DefaultChannelBuffer
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.Overflow == 0 {
+		cfg.Overflow = OverflowBlock
+	}
+	if cfg.OverflowWait <= 0 {
+		cfg.OverflowWait = DefaultOverflowWait
+	}
+	if cfg.SpillDir == "" {
+		cfg.SpillDir = filepath.Join(cfg.DataDir(), DefaultSpillDir)
+	}
+	if cfg.WalSegment <= 0 {
+		cfg.WalSegment = DefaultWalSegment
+	}
+	if cfg.WalFull == 0 {
+		cfg.WalFull = WalFullDrop
+	}
+	if cfg.WriteRetries == 0 {
+		cfg.WriteRetries = DefaultWriteRetries
+	}
+	if cfg.WriteBackoff <= 0 {
+		cfg.WriteBackoff = DefaultWriteBackoff
+	}
+	if cfg.WriteMaxBackoff <= 0 {
+		cfg.WriteMaxBackoff = DefaultWriteMaxWait
+	}
+	if cfg.DeadLetterDir == "" {
+		cfg.DeadLetterDir = filepath.Join(cfg.DataDir(), DefaultDeadLetterDir)
+	}
+	if cfg.BreakerThreshold == 0 {
+		cfg.BreakerThreshold = DefaultBreakerLimit
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = DefaultBreakerWait
+	}
+	if cfg.RetentionAction == 0 {
+		cfg.RetentionAction = RetentionDrop
+	}
+	if cfg.ExportDir == "" {
+		cfg.ExportDir = filepath.Join(cfg.DataDir(), DefaultExportDir)
+	}
+	if cfg.JanitorInterval <= 0 {
+		cfg.JanitorInterval = DefaultJanitorTick
+	}
+}
+
+// DataDir returns the directory of the files of the instance when their directories are not
+// configured, <user cache directory>/logcrane/<ServerId>, or "default" if ServerId is empty.
+// The temporary directory is used if there is no user cache directory
+func (cfg *Config) DataDir() string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	name := strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(cfg.ServerId)
+	if name == "" || name == "." || name == ".." {
+		name = "default"
+	}
+	return filepath.Join(base, "logcrane", name)
+}
+
+// Table returns the configuration of the table, the fields not overridden are
+// filled with the global ones
+func (cfg *Config) Table(tableName string) TableConfig {
+	table := cfg.Tables[tableName]
+	if table.BatchSize <= 0 {
+		table.BatchSize = cfg.BatchSize
+	}
+	if table.FlushInterval <= 0 {
+		table.FlushInterval = cfg.FlushInterval
+	}
+	if table.Overflow == 0 {
+		table.Overflow = cfg.Overflow
+	}
+	if table.OverflowWait <= 0 {
+		table.OverflowWait = cfg.OverflowWait
+	}
+	return table
+}
+
+// Spilling returns whether any table uses OverflowSpill
+func (cfg *Config) Spilling() bool {
+	if cfg.Overflow == OverflowSpill {
+		return true
+	}
+	for _, table := range cfg.Tables {
+		if table.Overflow == OverflowSpill {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,22 @@
 // The def package defines the all the const and struct we need
 package def
 
+import (
+	"container/list"
+	"context"
+	"io"
+)
+
 // Log database type
 const (
-	MySql = 1
-	Mongo = 2
+	MySql      = 1
+	Mongo      = 2
+	SQLite     = 3
+	Postgres   = 4
+	ClickHouse = 5
+	JsonLines  = 6
+	Csv        = 7
+	Tsv        = 8
 )
 
 // Log record type
@@ -14,6 +26,43 @@ const (
 	Update = 3
 )
 
+// Log system status
+const (
+	StatusStopped    = 0 // not started or stopped
+	StatusConnecting = 1 // started, the logs are buffered until the database is connected
+	StatusLive       = 2 // the logs are being saved
+)
+
+// Overflow policies of Execute when the log buffer is full
+const (
+	OverflowBlock        = 1 // block until the buffer has room, the default
+	OverflowBlockTimeout = 2 // block until the buffer has room or the timeout, then drop the log
+	OverflowDropNewest   = 3 // drop the log being executed
+	OverflowDropOldest   = 4 // drop the oldest log in the buffer to make room
+	OverflowSpill        = 5 // write the log to a spill file, and execute it again when the buffer has room
+)
+
+// Policies of Execute when the write-ahead log reaches Config.WalMaxSize
+const (
+	WalFullDrop         = 1 // drop the log being executed, the default
+	WalFullDeleteOldest = 2 // delete the oldest segments, the logs in them are not durable any more
+	WalFullSkip         = 3 // accept the log without writing it ahead
+)
+
+// Sinks of the logs failed to save permanently, see Config.DeadLetter
+const (
+	DeadLetterLog   = 0 // print the logs, the default
+	DeadLetterFile  = 1 // append the logs to the json lines files in Config.DeadLetterDir
+	DeadLetterTable = 2 // insert the logs into the dead letter table of the log database
+)
+
+// Actions of the retention janitor on the expired tables, see Config.RetentionAction
+const (
+	RetentionDrop    = 1 // drop the tables, the default
+	RetentionArchive = 2 // move the tables into Config.ArchiveSchema
+	RetentionExport  = 3 // export the rows into the json lines files in Config.ExportDir, then drop the tables
+)
+
 // Over BatchCleanTime, clean all the logs in the channel buffer
 const (
 	BatchCleanTime = 10
@@ -21,10 +70,13 @@ const (
 
 // Log table split type
 const (
-	Never         = 0
-	RollTypeDay   = 1
-	RollTypeMonth = 2
-	RollTypeYear  = 3
+	Never          = 0
+	RollTypeDay    = 1
+	RollTypeMonth  = 2
+	RollTypeYear   = 3
+	RollTypeHour   = 4
+	RollTypeWeek   = 5 // ISO week, which starts on Monday
+	RollTypeCustom = 6 // rolled by Roller.TableSuffix()
 )
 
 // Mysql column types
@@ -45,8 +97,6 @@ const (
 	TEXT      = "text"
 )
 
-const DataBase = MySql
-
 const (
 	NamePkId       = "pk_id"
 	NamePlayerId   = "player_id"
@@ -60,10 +110,6 @@ const (
 	IndexTypePK = "primary"
 )
 
-var ServerId string
-var BatchNum int
-var ChannelBuffer int
-
 // Logger is the interface which all the logs MUST implement
 type Logger interface {
 	TableName() string // return the name of the db table where the log is going to insert
@@ -71,6 +117,54 @@ type Logger interface {
 	SaveType() int32   // return the log should be recorded single or batch
 }
 
+// Backend is the interface which all the log storages MUST implement. The workers
+// call it to create tables and save logs, so it must be safe for concurrent use
+type Backend interface {
+	EnsureTable(cLog Logger, tableFullName string, saveType, rollType int32) error // create the table of cLog if it not exists, saveType and rollType are the ones in effect
+	InsertOne(cLog Logger, tableFullName string) error                             // save a single log
+	InsertBatch(logs *list.List, tableFullName string) error                       // save a batch of logs
+	UpsertBatch(logs *list.List, tableFullName string) error                       // save a batch of logs, update them if they exist
+	Close() error                                                                  // release the storage
+}
+
+// Classifier is implemented by the backends which know the errors of their storages.
+// The transient errors are retried, and the others fail the logs permanently
+type Classifier interface {
+	Transient(err error) bool // return whether saving the logs again may succeed
+}
+
+// ContextWriter is implemented by the backends whose writes can be canceled. The logs are saved
+// through it within the context of the caller, instead of InsertOne, InsertBatch and UpsertBatch
+type ContextWriter interface {
+	InsertBatchContext(ctx context.Context, logs *list.List, tableFullName string) error // save a batch of logs within ctx
+	UpsertBatchContext(ctx context.Context, logs *list.List, tableFullName string) error // save a batch of logs within ctx, update them if they exist
+}
+
+// Catalog is implemented by the backends which record the tables created by the log system
+type Catalog interface {
+	SaveTable(entry TableEntry) error                             // record the table, the creation time of a recorded table is kept and its row estimate refreshed
+	Tables(logTable string, from, to int64) ([]TableEntry, error) // return the tables of the log whose periods overlap [from, to) in unix seconds
+	DeleteTable(tableFullName string) error                       // forget the table removed
+}
+
+// Roller is implemented by the logs of RollTypeCustom, which decide their own rolled tables
+type Roller interface {
+	TableSuffix() string // return the suffix of the table name like "s12", the table is not rolled if it is empty
+}
+
+// Retainer is implemented by the logs whose rolled tables expire
+type Retainer interface {
+	Retention() int // return how many periods of tables are kept, including the current one
+}
+
+// Remover is implemented by the backends whose expired tables can be removed by the retention janitor
+type Remover interface {
+	ListTables(logTable string) ([]string, error)               // return the tables whose names start with logTable
+	DropTable(tableFullName string) error                       // drop the table
+	ArchiveTable(tableFullName, schema string) error            // move the table into the schema
+	ExportTable(tableFullName string, w io.Writer) (int, error) // write the rows of the table as json lines, and return how many rows
+}
+
 // BasePlayerLog contains the basic player log's attributes, all the player logs should extend of it
 // or includes them in it by yourself
 type BasePlayerLog struct {
@@ -102,8 +196,60 @@ type ColumnDef struct {
 	Index   string // index name
 }
 
-// LogCounter counts the logs number we deal successfully
+// LogCounter counts the logs number we deal successfully, and the logs dropped or spilled
+// because the buffer is full
 type LogCounter struct {
 	TotalCount uint64 // the total count
 	Count      uint64 // the count in one of the monitor tick
+	Dropped    uint64 // the total count of dropped logs
+	Spilled    uint64 // the total count of spilled logs
+	Dead       uint64 // the total count of logs failed to save permanently
+	Deferred   uint64 // the total count of logs deferred because the database is unavailable
+	Backfilled uint64 // the total count of deferred logs saved later
+}
+
+// DeadLetter is a log failed to save permanently, it keeps the original log in json
+type DeadLetter struct {
+	Base     BaseServerLog
+	LogTable string `type:"varchar" length:"255" explain:"日志表名" name:"log_table" key:"log_table"`
+	Error    string `type:"text" explain:"错误" name:"error"`
+	Log      string `type:"text" explain:"日志内容" name:"log"`
+}
+
+func (log DeadLetter) TableName() string {
+	return "log_dead_letter"
+}
+
+func (log DeadLetter) RollType() int32 {
+	return Never
+}
+
+func (log DeadLetter) SaveType() int32 {
+	return Batch
+}
+
+// TableEntry is a table created by the log system, recorded in the catalog table
+type TableEntry struct {
+	LogTable      string `type:"varchar" length:"255" explain:"日志表名" name:"log_table" key:"log_table"`
+	TableFullName string `type:"varchar" length:"255" explain:"分表名" name:"table_name" key:"primary"`
+	Roll          int32  `type:"int" explain:"分表类型" name:"roll_type"`
+	PeriodStart   int64  `type:"bigint" explain:"分表的开始时间" name:"period_start"`
+	PeriodEnd     int64  `type:"bigint" explain:"分表的结束时间，不分表时为0" name:"period_end"`
+	SchemaHash    string `type:"varchar" length:"64" explain:"表结构哈希" name:"schema_hash"`
+	Columns       string `type:"text" length:"65535" explain:"列" name:"columns"`
+	CreatedAt     int64  `type:"bigint" explain:"创建时间" name:"created_at"`
+	Seq           int64  `type:"bigint" explain:"登记顺序" name:"seq"`
+	RowEstimate   int64  `type:"bigint" explain:"估计行数" name:"row_estimate"`
+}
+
+func (entry TableEntry) TableName() string {
+	return "log_catalog"
+}
+
+func (entry TableEntry) RollType() int32 {
+	return Never
+}
+
+func (entry TableEntry) SaveType() int32 {
+	return Update
 }
@@ -1,5 +1,27 @@
 module github.com/cranewill/logcrane
 
-go 1.12
+go 1.20
 
-require github.com/go-sql-driver/mysql v1.4.1
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/ClickHouse/clickhouse-go v1.5.4
+	github.com/go-sql-driver/mysql v1.4.1
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.32
+	go.mongodb.org/mongo-driver v1.17.6
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/cloudflare/golz4 v0.0.0-20150217214814-ef862a3cdc58 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/klauspost/compress v1.16.7 // indirect
+	github.com/montanaflynn/stats v0.7.1 // indirect
+	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
+	github.com/xdg-go/scram v1.1.2 // indirect
+	github.com/xdg-go/stringprep v1.0.4 // indirect
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78 // indirect
+	golang.org/x/crypto v0.26.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+)
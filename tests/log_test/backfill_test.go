@@ -0,0 +1,112 @@
+package log_test
+
+import (
+	"context"
+	"github.com/cranewill/logcrane/core"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"github.com/cranewill/logcrane/wal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBackfill defers the logs while the database is down, and saves them into the
+// tables of the day they were created when it is up again
+func TestBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFake()
+	fake.setDown(true)
+	c, err := crane.New(def.Config{
+		DataBase:         fake.typ,
+		BatchSize:        5,
+		FlushInterval:    20 * time.Millisecond,
+		WriteRetries:     -1,
+		BreakerThreshold: 1,
+		BreakerCooldown:  50 * time.Millisecond,
+		SpillDir:         dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	yesterday := time.Now().AddDate(0, 0, -1)
+	for i := 0; i < 12; i++ {
+		oLog := logs.NewOnlineLog("player", "source", "127.0.0.1", "")
+		oLog.Base.CreateTime = yesterday.Unix()
+		c.Execute(oLog)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if errs, ok := c.Flush(ctx).(core.Errors); !ok || len(errs) != 1 || errs[0] != core.ErrDeferred {
+		t.Fatalf("flush error %v, want the logs deferred", errs)
+	}
+	if deferred := c.Counters()["log_online"].Deferred; deferred != 12 {
+		t.Fatalf("%d logs deferred, want 12", deferred)
+	}
+	fake.setDown(false)
+	for i := 0; i < 100 && c.Counters()["log_online"].Backfilled < 12; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if backfilled := c.Counters()["log_online"].Backfilled; backfilled != 12 {
+		t.Fatalf("%d logs backfilled, want 12", backfilled)
+	}
+	rows := fake.written()
+	tableFullName := utils.GetTableFullNameByTime("log_online", def.RollTypeDay, yesterday)
+	if rows[tableFullName] != 12 || len(rows) != 1 {
+		t.Fatalf("rows %v, want 12 rows in %s", rows, tableFullName)
+	}
+}
+
+// TestDeferredAcked acknowledges the deferred logs in the write-ahead log once the backfill
+// file is synced, they are backfilled rather than replayed after restarted
+func TestDeferredAcked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deferred_acked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFake()
+	fake.setDown(true)
+	walDir := filepath.Join(dir, "wal")
+	c, err := crane.New(def.Config{
+		DataBase:         fake.typ,
+		FlushInterval:    time.Hour,
+		WriteRetries:     -1,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+		SpillDir:         filepath.Join(dir, "spill"),
+		WalDir:           walDir,
+		WalSync:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		c.Execute(logs.NewOnlineLog("player", "source", "127.0.0.1", ""))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if errs, ok := c.Flush(ctx).(core.Errors); !ok || len(errs) != 1 || errs[0] != core.ErrDeferred {
+		t.Fatalf("flush error %v, want the logs deferred", errs)
+	}
+	c.Stop()
+	w, records, err := wal.Open(walDir, wal.Options{})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("%d records left in the write-ahead log, error %v, want 0", len(records), err)
+	}
+	w.Close()
+	content, err := ioutil.ReadFile(filepath.Join(dir, "spill", "log_online.backfill"))
+	if lines := strings.Count(string(content), "\n"); err != nil || lines != 5 {
+		t.Fatalf("%d logs in the backfill file, error %v, want 5", lines, err)
+	}
+}
@@ -0,0 +1,58 @@
+package log_test
+
+import (
+	"context"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestCatalog records the created tables, and lists them by time
+func TestCatalog(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "catalog.db")
+	os.Remove(file)
+	c, err := crane.New(def.Config{
+		ServerId: "server_catalog",
+		DataBase: def.SQLite,
+		DbName:   file,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+	c.Execute(oLog)
+	c.Execute(logs.NewPlayerInfo("player", "sdk", "server_catalog", "location", "cn", 1, time.Now().Unix()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	tables, err := c.Tables(oLog.TableName(), now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := utils.GetSchema(oLog)
+	if len(tables) != 1 {
+		t.Fatalf("tables %+v, want today's table", tables)
+	}
+	entry := tables[0]
+	if entry.TableFullName != utils.GetTableFullName(oLog, def.RollTypeDay) || entry.Roll != def.RollTypeDay ||
+		entry.SchemaHash != hash || entry.PeriodStart > now.Unix() || entry.PeriodEnd <= now.Unix() || entry.CreatedAt == 0 {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+	if tables, err = c.Tables(oLog.TableName(), now.AddDate(0, 0, -3), now.AddDate(0, 0, -2)); err != nil || len(tables) != 0 {
+		t.Fatalf("tables %+v, error %v, want none", tables, err)
+	}
+	if tables, err = c.Tables("player_info", now.AddDate(-1, 0, 0), now.AddDate(0, 0, -2)); err != nil ||
+		len(tables) != 1 || tables[0].TableFullName != "player_info" {
+		t.Fatalf("tables %+v, error %v, want player_info of all time", tables, err)
+	}
+}
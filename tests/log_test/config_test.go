@@ -0,0 +1,129 @@
+package log_test
+
+import (
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	files := map[string]string{
+		"logcrane.yaml": `
+server_id: s1
+database: mysql
+host: 127.0.0.1
+port: 3306
+user: root
+params:
+  charset: utf8mb4
+batch_size: 200
+flush_interval: 2s
+tables:
+  log_online:
+    batch_size: 500
+    save_type: single
+  log_chat:
+    disabled: true
+`,
+		"logcrane.json": `{"server_id": "s1", "database": "mysql", "host": "127.0.0.1", "port": 3306, "user": "root",
+"params": {"charset": "utf8mb4"}, "batch_size": 200, "flush_interval": "2s",
+"tables": {"log_online": {"batch_size": 500, "save_type": "single"}, "log_chat": {"disabled": true}}}`,
+		"logcrane.toml": `
+server_id = "s1"
+database = "mysql"
+host = "127.0.0.1"
+port = 3306
+user = "root"
+batch_size = 200
+flush_interval = "2s"
+[params]
+charset = "utf8mb4"
+[tables.log_online]
+batch_size = 500
+save_type = "single"
+[tables.log_chat]
+disabled = true
+`,
+	}
+	env := map[string]string{
+		"LOGCRANE_PASSWORD":                        "secret",
+		"LOGCRANE_DATABASE":                        "postgres",
+		"LOGCRANE_BATCH_SIZE":                      "300",
+		"LOGCRANE_PARAMS":                          "sslmode=disable",
+		"LOGCRANE_TABLE_LOG_ONLINE_FLUSH_INTERVAL": "1m",
+		"LOGCRANE_DISABLED_TABLES":                 "player_info",
+		"LOGCRANE_TABLE_PLAYER_INFO_OVERFLOW":      "spill",
+		"LOGCRANE_DEAD_LETTER":                     "table",
+		"LOGCRANE_WRITE_BACKOFF":                   "50ms",
+	}
+	for key, value := range env {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+	dir := filepath.Dir(dbFile)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := crane.LoadConfig(path)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if cfg.ServerId != "s1" || cfg.Host != "127.0.0.1" || cfg.Port != 3306 || cfg.User != "root" || cfg.Password != "secret" {
+			t.Fatalf("%s: unexpected connection %+v", name, cfg)
+		}
+		if cfg.DataBase != def.Postgres || cfg.BatchSize != 300 || cfg.FlushInterval != 2*time.Second {
+			t.Fatalf("%s: unexpected config %+v", name, cfg)
+		}
+		if cfg.Params["charset"] != "utf8mb4" || cfg.Params["sslmode"] != "disable" {
+			t.Fatalf("%s: unexpected params %v", name, cfg.Params)
+		}
+		online := cfg.Tables["log_online"]
+		if online.BatchSize != 500 || online.SaveType != def.Single || online.FlushInterval != time.Minute {
+			t.Fatalf("%s: unexpected log_online %+v", name, online)
+		}
+		if !cfg.Tables["log_chat"].Disabled || !cfg.Tables["player_info"].Disabled {
+			t.Fatalf("%s: unexpected tables %+v", name, cfg.Tables)
+		}
+		if !cfg.Spilling() || cfg.Tables["player_info"].Overflow != def.OverflowSpill {
+			t.Fatalf("%s: player_info overflow %d, want spill", name, cfg.Tables["player_info"].Overflow)
+		}
+		if cfg.DeadLetter != def.DeadLetterTable || cfg.WriteBackoff != 50*time.Millisecond {
+			t.Fatalf("%s: dead letter %d, write backoff %v", name, cfg.DeadLetter, cfg.WriteBackoff)
+		}
+		if table := cfg.Table("log_chat"); table.BatchSize != 300 {
+			t.Fatalf("%s: log_chat batch size %d, want the global one", name, table.BatchSize)
+		}
+	}
+
+	os.Setenv("LOGCRANE_TABLE_LOG_ONLINE_SAVE_TYPE", "unknown")
+	defer os.Unsetenv("LOGCRANE_TABLE_LOG_ONLINE_SAVE_TYPE")
+	if _, err := crane.LoadConfig(""); err == nil {
+		t.Fatal("unknown save type should fail")
+	}
+}
+
+// TestLoadConfigUnknownKeys refuses the config files with misspelled keys in every format
+func TestLoadConfigUnknownKeys(t *testing.T) {
+	files := map[string]string{
+		"unknown.yaml": "server_id: s1\nbatch_sise: 200\n",
+		"unknown.json": `{"server_id": "s1", "batch_sise": 200}`,
+		"unknown.toml": "server_id = \"s1\"\nbatch_sise = 200\n",
+	}
+	dir := filepath.Dir(dbFile)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := crane.LoadConfig(path); err == nil || !strings.Contains(err.Error(), "batch_sise") {
+			t.Fatalf("%s: load returns %v, want the unknown key", name, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package log_test
+
+import (
+	"container/list"
+	"database/sql/driver"
+	"errors"
+	"github.com/cranewill/logcrane/backend"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeTypes is the last database type registered for a fakeBackend, above the real ones
+var fakeTypes int32 = 100
+
+// fakeBackend is a database of the tests which behaves as its fields are set. Every test
+// creates its own by newFake, so the tests share no state and can run in parallel
+type fakeBackend struct {
+	typ    int32         // the database type of the backend, set DataBase to it
+	gate   chan struct{} // the writes block until it is closed if it is not nil, see open
+	broken bool          // the writes always fail permanently
+	poison string        // the batches with an online log of the player fail permanently
+	flaky  int64         // how many writes fail transiently
+	down   int32         // the writes fail transiently while it is 1, see setDown
+	mu     sync.Mutex
+	rows   map[string]int // tableFullName -> rows written
+}
+
+// newFake registers a new fakeBackend under a database type of its own
+func newFake() *fakeBackend {
+	f := &fakeBackend{
+		typ:  atomic.AddInt32(&fakeTypes, 1),
+		rows: make(map[string]int),
+	}
+	backend.Register(f.typ, func(cfg *def.Config) (def.Backend, error) {
+		return f, nil
+	})
+	return f
+}
+
+func (f *fakeBackend) EnsureTable(cLog def.Logger, tableFullName string, saveType, rollType int32) error {
+	return nil
+}
+func (f *fakeBackend) InsertOne(cLog def.Logger, tableFullName string) error {
+	l := list.New()
+	l.PushBack(cLog)
+	return f.InsertBatch(l, tableFullName)
+}
+func (f *fakeBackend) InsertBatch(batch *list.List, tableFullName string) error {
+	if f.gate != nil {
+		<-f.gate
+	}
+	if f.broken {
+		return errors.New("insert failed")
+	}
+	if atomic.LoadInt32(&f.down) == 1 || atomic.AddInt64(&f.flaky, -1) >= 0 {
+		return driver.ErrBadConn
+	}
+	for e := batch.Front(); e != nil; e = e.Next() {
+		if oLog, ok := e.Value.(def.Logger).(*logs.OnlineLog); ok && f.poison != "" && oLog.Base.PlayerId == f.poison {
+			return errors.New("poison log")
+		}
+	}
+	f.mu.Lock()
+	f.rows[tableFullName] += batch.Len()
+	f.mu.Unlock()
+	return nil
+}
+func (f *fakeBackend) UpsertBatch(batch *list.List, tableFullName string) error {
+	return f.InsertBatch(batch, tableFullName)
+}
+func (f *fakeBackend) Close() error             { return nil }
+func (f *fakeBackend) Transient(err error) bool { return backend.IsTransient(err) }
+
+// open lets the writes blocked by the gate go, it can be called more than once
+func (f *fakeBackend) open() {
+	select {
+	case <-f.gate:
+	default:
+		close(f.gate)
+	}
+}
+
+// setDown makes the database unavailable or available again
+func (f *fakeBackend) setDown(down bool) {
+	if down {
+		atomic.StoreInt32(&f.down, 1)
+	} else {
+		atomic.StoreInt32(&f.down, 0)
+	}
+}
+
+// written returns a copy of the rows written of every table
+func (f *fakeBackend) written() map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rows := make(map[string]int, len(f.rows))
+	for tableFullName, n := range f.rows {
+		rows[tableFullName] = n
+	}
+	return rows
+}
+
+// total returns the rows written of all the tables
+func (f *fakeBackend) total() int {
+	n := 0
+	for _, rows := range f.written() {
+		n += rows
+	}
+	return n
+}
+
+// waitRows waits until n rows are written
+func (f *fakeBackend) waitRows(t *testing.T, n int) {
+	for i := 0; i < 100 && f.total() < n; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if rows := f.total(); rows != n {
+		t.Fatalf("%d rows written, want %d", rows, n)
+	}
+}
@@ -0,0 +1,93 @@
+package log_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cranewill/logcrane/core"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestFlush flushes the batches long before the flush interval
+func TestFlush(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "flush.db")
+	os.Remove(file)
+	c, err := crane.New(def.Config{
+		ServerId:      "server_flush",
+		DataBase:      def.SQLite,
+		DbName:        file,
+		BatchSize:     1000,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+	for i := 0; i < 50; i++ {
+		c.Execute(oLog)
+		c.Execute(logs.NewPlayerInfo("player", "sdk", "server_flush", "location", "cn", int32(i), time.Now().Unix()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.FlushTable(ctx, oLog.TableName()); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", file+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	count := func(tableFullName string) int {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM \"" + tableFullName + "\"").Scan(&n); err != nil {
+			return -1
+		}
+		return n
+	}
+	if n := count(utils.GetTableFullName(oLog, oLog.RollType())); n != 50 {
+		t.Fatalf("%d online logs after FlushTable, want 50", n)
+	}
+	if n := count(logs.PlayerInfo{}.TableName()); n != -1 {
+		t.Fatalf("%d player infos after FlushTable, want no table", n)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(logs.PlayerInfo{}.TableName()); n != 1 {
+		t.Fatalf("%d player infos after Flush, want 1", n)
+	}
+}
+
+// TestFlushError reports the failed writes of every table
+func TestFlushError(t *testing.T) {
+	fake := newFake()
+	fake.broken = true
+	c, err := crane.New(def.Config{DataBase: fake.typ, BatchSize: 10, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	for i := 0; i < 25; i++ {
+		c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+		c.Execute(logs.NewPlayerInfo("player", "sdk", "server", "location", "cn", int32(i), time.Now().Unix()))
+	}
+	err = c.Flush(context.Background())
+	errs, ok := err.(core.Errors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("flush returns %v, want errors of 2 tables", err)
+	}
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("flush again returns %v, want nil", err)
+	}
+	c.Stop()
+	if err := c.Flush(context.Background()); err != core.ErrStopped {
+		t.Fatalf("flush after stop returns %v", err)
+	}
+}
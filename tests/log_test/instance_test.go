@@ -0,0 +1,119 @@
+package log_test
+
+import (
+	"database/sql"
+	"github.com/cranewill/logcrane/core"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestInstances runs two LogCranes logging into their own databases with their own server ids
+func TestInstances(t *testing.T) {
+	dir := filepath.Dir(dbFile)
+	serverIds := []string{"server_a", "server_b"}
+	files := make([]string, 0, len(serverIds))
+	for _, serverId := range serverIds {
+		file := filepath.Join(dir, serverId+".db")
+		files = append(files, file)
+		c, err := crane.New(def.Config{
+			ServerId:      serverId,
+			DataBase:      def.SQLite,
+			DbName:        file,
+			FlushInterval: 100 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+		}
+		defer c.Stop()
+	}
+	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+	for i, file := range files {
+		checkServerId(t, file, utils.GetTableFullName(oLog, oLog.RollType()), serverIds[i], 10)
+	}
+}
+
+// TestLazy starts a LogCrane whose database can not be opened, and opens it later
+func TestLazy(t *testing.T) {
+	dir := filepath.Join(filepath.Dir(dbFile), "lazy")
+	file := filepath.Join(dir, "lazy.db")
+	c, err := crane.New(def.Config{
+		ServerId:      "server_lazy",
+		DataBase:      def.SQLite,
+		DbName:        file,
+		FlushInterval: 100 * time.Millisecond,
+		Lazy:          true,
+		RetryInterval: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	if c.Status() != def.StatusConnecting {
+		t.Fatalf("status %d, want connecting", c.Status())
+	}
+	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+	for i := 0; i < 10; i++ {
+		c.Execute(oLog)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	checkServerId(t, file, utils.GetTableFullName(oLog, oLog.RollType()), "server_lazy", 10)
+	if c.Status() != def.StatusLive {
+		t.Fatalf("status %d, want live", c.Status())
+	}
+}
+
+// checkServerId waits until the table has n rows, and checks all of them have the server id
+func checkServerId(t *testing.T, file, tableFullName, serverId string, n int) {
+	db, err := sql.Open("sqlite3", file+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	for i := 0; i < 100; i++ {
+		err = db.QueryRow("SELECT COUNT(*) FROM \""+tableFullName+"\" WHERE server_id = ?", serverId).Scan(&count)
+		if err == nil && count >= n {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s has %d rows of %s, want %d, last error %v", file, count, serverId, n, err)
+}
+
+// TestInstanceDirs gives every instance its own directories, and refuses to start an instance
+// whose directories are used by a running one
+func TestInstanceDirs(t *testing.T) {
+	dir := filepath.Dir(dbFile)
+	a, err := crane.New(def.Config{ServerId: "server_dirs", DataBase: def.SQLite, DbName: filepath.Join(dir, "dirs.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := crane.New(def.Config{ServerId: "server_dirs", DataBase: def.SQLite, DbName: filepath.Join(dir, "dirs.db")}); err != core.ErrDirInUse {
+		t.Fatalf("the second instance returns %v, want ErrDirInUse", err)
+	}
+	b, err := crane.New(def.Config{ServerId: "server_dirs_b", DataBase: def.SQLite, DbName: filepath.Join(dir, "dirs_b.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	if a.Config.SpillDir == b.Config.SpillDir || !filepath.IsAbs(a.Config.SpillDir) {
+		t.Fatalf("spill directories %s and %s", a.Config.SpillDir, b.Config.SpillDir)
+	}
+	a.Stop()
+	c, err := crane.New(def.Config{ServerId: "server_dirs", DataBase: def.SQLite, DbName: filepath.Join(dir, "dirs.db")})
+	if err != nil {
+		t.Fatalf("the directories are not released by Stop: %v", err)
+	}
+	c.Stop()
+}
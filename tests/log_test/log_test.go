@@ -1,11 +1,17 @@
 package log_test
 
 import (
+	"container/list"
+	"database/sql"
 	"fmt"
 	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
 	"github.com/cranewill/logcrane/logs"
 	"github.com/cranewill/logcrane/utils"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -13,44 +19,93 @@ import (
 
 const ServerId = "TestServer"
 
+// dbFile is the sqlite database file the tests log into
+var dbFile string
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "logcrane")
+	if err != nil {
+		panic(err)
+	}
+	dbFile = filepath.Join(dir, "test.db")
+	cfg := def.Config{
+		ServerId:    ServerId,
+		DataBase:    def.SQLite,
+		DbName:      dbFile,
+		Params:      map[string]string{"_busy_timeout": "5000"},
+		MonitorTick: 5 * time.Second,
+	}
+	if err := crane.Start(cfg); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	crane.Stop()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// waitRows waits until the table has at least n rows, and returns the row count
+func waitRows(t *testing.T, tableFullName string, n int) int {
+	db, err := sql.Open("sqlite3", dbFile+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	for i := 0; i < 150; i++ {
+		err = db.QueryRow("SELECT COUNT(*) FROM \"" + tableFullName + "\"").Scan(&count)
+		if err == nil && count >= n {
+			return count
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("%s has %d rows, want %d, last error %v", tableFullName, count, n, err)
+	return count
+}
+
 func TestReflection(t *testing.T) {
-	crane.Start(ServerId, "root", "starunion", "test", 5)
 	start := time.Now().Unix()
 	for i := 0; i < 1000000; i++ {
 		oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
-		insertStmt := utils.GetInsertSql(oLog)
-		values := utils.GetInsertValues(oLog)
-		preparedStmt := insertStmt + "(" + values + ");"
-		_ = preparedStmt
+		batch := list.New()
+		batch.PushBack(oLog)
+		preparedStmt, args := utils.GetInsertSqlAndArgs(utils.MysqlDialect{}, batch, "log_online")
+		_, _ = preparedStmt, args
 	}
 	cost := time.Now().Unix() - start
 	fmt.Println(strconv.FormatInt(cost, 10))
 }
 
-func TestCraneLog(t *testing.T) {
-	crane.Start(ServerId, "root", "starunion", "test", 5)
+func TestStart(t *testing.T) {
+	if crane.Status() != def.StatusLive {
+		t.Fatalf("status %d, want live", crane.Status())
+	}
+	if err := crane.Start(def.Config{DataBase: def.SQLite, DbName: dbFile}); err != crane.ErrStarted {
+		t.Fatalf("start twice returns %v", err)
+	}
+}
 
+func TestCraneLog(t *testing.T) {
 	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
 	for i := 0; i < 1000; i++ {
 		crane.Instance().Execute(oLog)
 	}
-	for {
-		time.Sleep(time.Second)
-	}
+	waitRows(t, utils.GetTableFullName(oLog, oLog.RollType()), 1000)
 }
 
 func TestUpdate(t *testing.T) {
-	crane.Start(ServerId, "root", "starunion", "test", 5)
-
+	ids := make(map[int32]bool)
 	for i := 0; i < 1000; i++ {
 		id := rand.Int31n(1000)
+		ids[id] = true
 		randStr := strconv.Itoa(int(id))
 		pLog := logs.NewPlayerInfo(randStr, randStr, "server"+randStr, "location"+randStr, "1"+randStr, id, time.Now().Unix())
 
 		crane.Instance().Execute(pLog)
 	}
-	for {
-		time.Sleep(time.Second * 3)
+	count := waitRows(t, logs.PlayerInfo{}.TableName(), len(ids))
+	if count != len(ids) {
+		t.Fatalf("player_info has %d rows, want %d", count, len(ids))
 	}
 }
 
@@ -0,0 +1,101 @@
+package log_test
+
+import (
+	"container/list"
+	"github.com/cranewill/logcrane/backend"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// migrateV1 and migrateV2 are two versions of the same log
+type migrateV1 struct {
+	Base def.BaseServerLog
+	Name string `type:"varchar" length:"64" name:"name"`
+	Old  int32  `type:"int" name:"old"`
+}
+
+func (migrateV1) TableName() string { return "log_migrate" }
+func (migrateV1) RollType() int32   { return def.Never }
+func (migrateV1) SaveType() int32   { return def.Batch }
+
+type migrateV2 struct {
+	Base  def.BaseServerLog
+	Name  string `type:"varchar" length:"255" name:"name"`
+	Level int32  `type:"int" name:"level" key:"level"`
+}
+
+func (migrateV2) TableName() string { return "log_migrate" }
+func (migrateV2) RollType() int32   { return def.Never }
+func (migrateV2) SaveType() int32   { return def.Batch }
+
+// TestMigrate adds the new columns and indexes to the existing table, and refuses to drop the old column
+func TestMigrate(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "migrate.db")
+	os.Remove(file)
+	b, err := backend.OpenSqlite(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	insert := func(cLog def.Logger) {
+		if err := b.EnsureTable(cLog, cLog.TableName(), cLog.SaveType(), cLog.RollType()); err != nil {
+			t.Fatal(err)
+		}
+		l := list.New()
+		l.PushBack(cLog)
+		if err := b.InsertBatch(l, cLog.TableName()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert(migrateV1{Name: "v1", Old: 1})
+	insert(migrateV2{Name: "v2", Level: 2})
+
+	m, err := b.PlanMigration(migrateV2{}, "log_migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Sqls) != 0 || len(m.Refused) != 1 || m.Refused[0] != "drop column old" {
+		t.Fatalf("unexpected migration %+v", m)
+	}
+	var level int32
+	if err := b.Db.QueryRow(`SELECT level FROM log_migrate WHERE name = 'v2'`).Scan(&level); err != nil || level != 2 {
+		t.Fatalf("level %d, error %v", level, err)
+	}
+	var index string
+	if err := b.Db.QueryRow(`SELECT name FROM sqlite_master WHERE type = 'index' AND name = 'log_migrate_level'`).Scan(&index); err != nil {
+		t.Fatal(err)
+	}
+
+	b.AllowDestructive = true
+	if err := b.EnsureTable(migrateV2{}, "log_migrate", def.Batch, def.Never); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = b.PlanMigration(migrateV2{}, "log_migrate"); err != nil || len(m.Sqls)+len(m.Refused) != 0 {
+		t.Fatalf("unexpected migration %+v, error %v", m, err)
+	}
+}
+
+// TestMigrationPlan widens the narrow columns in mysql, and refuses to narrow them
+func TestMigrationPlan(t *testing.T) {
+	columns := []def.ColumnDef{
+		{Name: "pk_id", Type: "INT"},
+		{Name: "server_id", Type: "VARCHAR", Length: 255},
+		{Name: "create_time", Type: "INT"},
+		{Name: "save_time", Type: "BIGINT"},
+		{Name: "action_id", Type: "VARCHAR", Length: 255},
+		{Name: "name", Type: "VARCHAR", Length: 64},
+		{Name: "level", Type: "BIGINT"},
+	}
+	m := utils.GetMigration(utils.MysqlDialect{}, migrateV2{}, "log_migrate", columns, []string{"PRIMARY", "level"}, false)
+	if len(m.Sqls) != 2 || !strings.Contains(m.Sqls[0], "MODIFY COLUMN `create_time` bigint") ||
+		!strings.Contains(m.Sqls[1], "MODIFY COLUMN `name` varchar(255)") {
+		t.Fatalf("unexpected statements %q", m.Sqls)
+	}
+	if len(m.Refused) != 1 || m.Refused[0] != "change column level bigint -> int" {
+		t.Fatalf("unexpected refused changes %q", m.Refused)
+	}
+}
@@ -0,0 +1,138 @@
+package log_test
+
+import (
+	"github.com/cranewill/logcrane/core"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newGated starts a LogCrane with tiny buffers whose writes block until the gate of the fake is opened
+func newGated(t *testing.T, cfg def.Config) (*core.LogCrane, *fakeBackend) {
+	fake := newFake()
+	fake.gate = make(chan struct{})
+	cfg.DataBase = fake.typ
+	cfg.BatchSize = 5
+	cfg.FlushInterval = 20 * time.Millisecond
+	cfg.ChannelBuffer = 5
+	c, err := crane.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, fake
+}
+
+// fill executes the logs until the buffer is full, and returns how many logs are accepted
+func fill(c *core.LogCrane, cLog def.Logger) int {
+	accepted := 0
+	for i := 0; i < 10; i++ { // the logs are lifted into the table channel at the same time
+		for c.TryExecute(cLog) {
+			accepted++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return accepted
+}
+
+// TestTryExecute drops the logs instead of blocking when the buffer is full
+func TestTryExecute(t *testing.T) {
+	c, fake := newGated(t, def.Config{Tables: map[string]def.TableConfig{
+		"player_info": {Overflow: def.OverflowBlockTimeout, OverflowWait: 50 * time.Millisecond},
+	}})
+	defer c.Stop()
+	defer fake.open()
+	accepted := fill(c, logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	if dropped := c.Counters()["log_online"].Dropped; dropped != 10 {
+		t.Fatalf("%d logs dropped, want 10", dropped)
+	}
+	start := time.Now()
+	c.Execute(logs.NewPlayerInfo("player", "sdk", "server", "location", "cn", 1, time.Now().Unix()))
+	if cost := time.Since(start); cost < 50*time.Millisecond {
+		t.Fatalf("Execute returns in %v, want blocking for 50ms", cost)
+	}
+	if dropped := c.Counters()["player_info"].Dropped; dropped != 1 {
+		t.Fatalf("%d player infos dropped, want 1", dropped)
+	}
+	fake.open()
+	fake.waitRows(t, accepted)
+}
+
+// TestDropOldest keeps the newest logs when the buffer is full
+func TestDropOldest(t *testing.T) {
+	c, fake := newGated(t, def.Config{Overflow: def.OverflowDropOldest})
+	defer c.Stop()
+	defer fake.open()
+	for i := 0; i < 100; i++ {
+		c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	}
+	dropped := c.Counters()["log_online"].Dropped
+	if dropped == 0 {
+		t.Fatal("no log dropped by a full buffer")
+	}
+	fake.open()
+	fake.waitRows(t, 100-int(dropped))
+}
+
+// TestDropOldestOtherTables never drops the logs of a blocking table to make room for a dropping one
+func TestDropOldestOtherTables(t *testing.T) {
+	c, fake := newGated(t, def.Config{Tables: map[string]def.TableConfig{
+		"log_online": {Overflow: def.OverflowDropOldest},
+	}})
+	defer c.Stop()
+	defer fake.open()
+	for i := 0; i < 10; i++ { // the worker of log_online waits for the gate, and its channel is full
+		c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	}
+	time.Sleep(100 * time.Millisecond)
+	blocked := make(chan struct{})
+	go func() { // fills the crane channel with the logs of a blocking table
+		defer close(blocked)
+		for i := 0; i < 30; i++ {
+			c.Execute(logs.NewPlayerInfo("player", "sdk", "server", "location", "cn", 1, time.Now().Unix()))
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 50; i++ {
+		c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	}
+	counters := c.Counters()
+	if dropped := counters["player_info"].Dropped; dropped != 0 {
+		t.Fatalf("%d player infos dropped for log_online", dropped)
+	}
+	dropped := counters["log_online"].Dropped
+	if dropped == 0 {
+		t.Fatal("no log_online dropped by a full buffer")
+	}
+	fake.open()
+	<-blocked
+	fake.waitRows(t, 30+60-int(dropped))
+	if dropped := c.Counters()["player_info"].Dropped; dropped != 0 {
+		t.Fatalf("%d player infos dropped for log_online", dropped)
+	}
+}
+
+// TestSpill spills the logs when the buffer is full, and replays them when it has room
+func TestSpill(t *testing.T) {
+	dir := filepath.Join(filepath.Dir(dbFile), "spill")
+	c, fake := newGated(t, def.Config{Overflow: def.OverflowSpill, SpillDir: dir})
+	defer c.Stop()
+	defer fake.open()
+	for i := 0; i < 100; i++ {
+		if !c.TryExecute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")) {
+			t.Fatal("spilled log is not accepted")
+		}
+	}
+	counter := c.Counters()["log_online"]
+	if counter.Spilled == 0 || counter.Dropped != 0 {
+		t.Fatalf("%d logs spilled, %d logs dropped, want spilled only", counter.Spilled, counter.Dropped)
+	}
+	fake.open()
+	fake.waitRows(t, 100)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d spill files left after replayed", len(files))
+	}
+}
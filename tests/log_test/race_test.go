@@ -0,0 +1,53 @@
+package log_test
+
+import (
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestConcurrent executes logs from many goroutines while the monitor prints and the
+// status is polled, and stops the LogCrane before they finish. Run it with -race
+func TestConcurrent(t *testing.T) {
+	for _, saveType := range []int32{def.Single, def.Batch} {
+		file := filepath.Join(filepath.Dir(dbFile), "concurrent_"+strconv.Itoa(int(saveType))+".db")
+		c, err := crane.New(def.Config{
+			ServerId:      "server_concurrent",
+			DataBase:      def.SQLite,
+			DbName:        file,
+			BatchSize:     10,
+			FlushInterval: 10 * time.Millisecond,
+			ChannelBuffer: 100,
+			MonitorTick:   10 * time.Millisecond,
+			Tables:        map[string]def.TableConfig{"log_online": {SaveType: saveType}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					id := strconv.Itoa(i*1000 + j%50)
+					c.Execute(logs.NewOnlineLog(id, "source", "127.0.0.1", ""))
+					c.Execute(logs.NewPlayerInfo(id, id, "server", "location", "cn", int32(j), time.Now().Unix()))
+					_ = c.Status()
+				}
+			}(i)
+		}
+		time.Sleep(50 * time.Millisecond)
+		c.Stop()
+		c.Stop()
+		wg.Wait()
+		if c.Status() != def.StatusStopped {
+			t.Fatalf("status %d, want stopped", c.Status())
+		}
+	}
+}
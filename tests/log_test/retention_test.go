@@ -0,0 +1,105 @@
+package log_test
+
+import (
+	"bufio"
+	"container/list"
+	"github.com/cranewill/logcrane/backend"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/utils"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// retainedLog keeps the tables of the last 3 days
+type retainedLog struct {
+	Base def.BaseServerLog
+	Name string `type:"varchar" length:"64" name:"name"`
+}
+
+func (retainedLog) TableName() string { return "log_retained" }
+func (retainedLog) RollType() int32   { return def.RollTypeDay }
+func (retainedLog) SaveType() int32   { return def.Batch }
+func (retainedLog) Retention() int    { return 3 }
+
+// TestRetention finds the expired tables in the catalog and by their names, keeps them in dry run,
+// then exports and drops them
+func TestRetention(t *testing.T) {
+	dir := filepath.Dir(dbFile)
+	file := filepath.Join(dir, "retention.db")
+	exportDir := filepath.Join(dir, "retention_export")
+	os.Remove(file)
+	os.RemoveAll(exportDir)
+	c, err := crane.New(def.Config{
+		ServerId:        "server_retention",
+		DataBase:        def.SQLite,
+		DbName:          file,
+		Logs:            []def.Logger{retainedLog{}},
+		RetentionAction: def.RetentionExport,
+		ExportDir:       exportDir,
+		RetentionDryRun: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	b := c.Backend().(*backend.SqlBackend)
+	now := time.Now()
+	create := func(daysAgo int, cataloged bool) string {
+		day := now.AddDate(0, 0, -daysAgo)
+		tableFullName := utils.GetTableFullNameByTime("log_retained", def.RollTypeDay, day)
+		if err := b.EnsureTable(retainedLog{}, tableFullName, def.Batch, def.RollTypeDay); err != nil {
+			t.Fatal(err)
+		}
+		l := list.New()
+		l.PushBack(retainedLog{Name: tableFullName})
+		if err := b.InsertBatch(l, tableFullName); err != nil {
+			t.Fatal(err)
+		}
+		if cataloged {
+			start, end := utils.GetPeriod(def.RollTypeDay, day)
+			if err := b.SaveTable(def.TableEntry{LogTable: "log_retained", TableFullName: tableFullName,
+				Roll: def.RollTypeDay, PeriodStart: start, PeriodEnd: end}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return tableFullName
+	}
+	old := create(10, true)
+	older := create(5, false)
+	create(2, true)
+	create(0, true)
+
+	cleaned, err := c.Clean(true)
+	if err != nil || len(cleaned) != 2 || cleaned[0] != old || cleaned[1] != older {
+		t.Fatalf("cleaned %q, error %v, want %s and %s", cleaned, err, old, older)
+	}
+	if tables, _ := b.ListTables("log_retained"); len(tables) != 4 {
+		t.Fatalf("tables %q after dry run", tables)
+	}
+
+	if cleaned, err = c.Clean(false); err != nil || len(cleaned) != 2 {
+		t.Fatalf("cleaned %q, error %v", cleaned, err)
+	}
+	if tables, _ := b.ListTables("log_retained"); len(tables) != 2 {
+		t.Fatalf("tables %q, want the last 3 days", tables)
+	}
+	if entries, _ := c.Tables("log_retained", now.AddDate(0, 0, -30), now); len(entries) != 2 {
+		t.Fatalf("catalog %+v, want the tables of 2 days ago and today", entries)
+	}
+	for _, tableFullName := range cleaned {
+		f, err := os.Open(filepath.Join(exportDir, tableFullName+".jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := 0
+		for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		}
+		f.Close()
+		if lines != 1 {
+			t.Fatalf("%d rows exported from %s", lines, tableFullName)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package log_test
+
+import (
+	"context"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/wal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestDeadLetter isolates the poison log of a batch, saves the others and keeps it in the dead letter file
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead_letter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFake()
+	fake.poison = "poison"
+	c, err := crane.New(def.Config{
+		DataBase:      fake.typ,
+		BatchSize:     20,
+		FlushInterval: time.Hour,
+		DeadLetter:    def.DeadLetterFile,
+		DeadLetterDir: dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		playerId := "player"
+		if i == 7 {
+			playerId = "poison"
+		}
+		oLog := logs.NewOnlineLog(playerId, "source", "127.0.0.1", "")
+		c.Execute(&oLog)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err == nil {
+		t.Fatal("flush succeeded with a poison log")
+	}
+	if rows := fake.total(); rows != 19 {
+		t.Fatalf("%d rows written, want 19", rows)
+	}
+	if dead := c.Counters()["log_online"].Dead; dead != 1 {
+		t.Fatalf("%d dead logs, want 1", dead)
+	}
+	c.Stop()
+	data, err := ioutil.ReadFile(filepath.Join(dir, def.DeadLetter{}.TableName()+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "poison") || !strings.Contains(lines[0], "poison log") {
+		t.Fatalf("dead letters %q, want the poison log with its error", lines)
+	}
+}
+
+// TestDeadLetterAcked acknowledges the printed dead letters in the write-ahead log, they are
+// not replayed by the next run
+func TestDeadLetterAcked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dead_letter_wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFake()
+	fake.poison = "poison"
+	c, err := crane.New(def.Config{ServerId: "server_dead_letter_wal", DataBase: fake.typ, FlushInterval: time.Hour, WalDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oLog := logs.NewOnlineLog("poison", "source", "127.0.0.1", "")
+	c.Execute(&oLog)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err == nil {
+		t.Fatal("flush succeeded with a poison log")
+	}
+	c.Stop()
+	w, records, err := wal.Open(dir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if len(records) != 0 {
+		t.Fatalf("%d records left in the write-ahead log, want the dead letter acknowledged", len(records))
+	}
+}
+
+// TestRetry saves the log after the transient errors
+func TestRetry(t *testing.T) {
+	fake := newFake()
+	fake.flaky = 2
+	c, err := crane.New(def.Config{
+		DataBase:      fake.typ,
+		FlushInterval: 10 * time.Millisecond,
+		WriteBackoff:  20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	oLog := logs.NewOnlineLog("player", "source", "127.0.0.1", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := c.ExecuteSync(ctx, &oLog); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < 60*time.Millisecond {
+		t.Fatalf("saved in %v, want two retries after 20ms and 40ms", cost)
+	}
+	if rows := fake.total(); rows != 1 {
+		t.Fatalf("%d rows written, want 1", rows)
+	}
+}
@@ -0,0 +1,182 @@
+package log_test
+
+import (
+	"context"
+	"github.com/cranewill/logcrane/backend"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// tradeLog is rolled by the time of the trade rather than its creation
+type tradeLog struct {
+	Base     def.BaseServerLog
+	TradedAt int64 `type:"bigint" name:"traded_at" roll:"true"`
+}
+
+func (tradeLog) TableName() string { return "log_trade" }
+func (tradeLog) RollType() int32   { return def.RollTypeMonth }
+func (tradeLog) SaveType() int32   { return def.Batch }
+
+// seasonLog is rolled by its season, the tables of the last 2 seasons are kept
+type seasonLog struct {
+	Base   def.BaseServerLog
+	Season int32 `type:"int" name:"season"`
+}
+
+func (seasonLog) TableName() string     { return "log_season" }
+func (seasonLog) RollType() int32       { return def.RollTypeCustom }
+func (seasonLog) SaveType() int32       { return def.Batch }
+func (seasonLog) Retention() int        { return 2 }
+func (l seasonLog) TableSuffix() string { return "s" + strconv.Itoa(int(l.Season)) }
+
+// TestRollTypes names the hourly and weekly tables, and parses the names back
+func TestRollTypes(t *testing.T) {
+	at := time.Date(2027, 1, 1, 15, 4, 5, 0, time.Local) // friday of the 53rd week of 2026
+	if name := utils.GetTableFullNameByTime("log_battle", def.RollTypeHour, at); name != "log_battle_2027010115" {
+		t.Fatalf("hourly table %s", name)
+	}
+	if name := utils.GetTableFullNameByTime("log_battle", def.RollTypeWeek, at); name != "log_battle_2026w53" {
+		t.Fatalf("weekly table %s", name)
+	}
+	monday := time.Date(2026, 12, 28, 0, 0, 0, 0, time.Local)
+	if start, end := utils.GetPeriod(def.RollTypeWeek, at); start != monday.Unix() || end != monday.AddDate(0, 0, 7).Unix() {
+		t.Fatalf("week from %v to %v", time.Unix(start, 0), time.Unix(end, 0))
+	}
+	if week, ok := utils.ParseTableTime("log_battle", "log_battle_2026w53", def.RollTypeWeek); !ok || !week.Equal(monday) {
+		t.Fatalf("parsed week %v, %v", week, ok)
+	}
+	if _, ok := utils.ParseTableTime("log_battle", "log_battle_2027w53", def.RollTypeWeek); ok {
+		t.Fatal("2027 has no 53rd week")
+	}
+	if hour, ok := utils.ParseTableTime("log_battle", "log_battle_2027010115", def.RollTypeHour); !ok || hour.Unix() != at.Unix()-at.Unix()%3600 {
+		t.Fatalf("parsed hour %v, %v", hour, ok)
+	}
+}
+
+// TestRollSeason saves the logs into the tables of their seasons, and keeps the tables of the last seasons
+func TestRollSeason(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "season.db")
+	os.Remove(file)
+	c, err := crane.New(def.Config{
+		ServerId:        "server_season",
+		DataBase:        def.SQLite,
+		DbName:          file,
+		RetentionDryRun: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for season := int32(1); season <= 3; season++ {
+		c.Execute(seasonLog{Season: season})
+		c.Execute(seasonLog{Season: season})
+		if err := c.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b := c.Backend().(*backend.SqlBackend)
+	if tables, _ := b.ListTables("log_season"); len(tables) != 3 {
+		t.Fatalf("tables %q, want one of each season", tables)
+	}
+	var n int
+	if err := b.Db.QueryRow(`SELECT COUNT(*) FROM "log_season_s2" WHERE season = 2`).Scan(&n); err != nil || n != 2 {
+		t.Fatalf("%d logs of season 2, error %v", n, err)
+	}
+	if cleaned, err := c.Clean(false); err != nil || len(cleaned) != 1 || cleaned[0] != "log_season_s1" {
+		t.Fatalf("cleaned %q, error %v, want the first season", cleaned, err)
+	}
+	if tables, _ := c.Tables("log_season", time.Now(), time.Now()); len(tables) != 2 {
+		t.Fatalf("tables %+v, want the last 2 seasons", tables)
+	}
+}
+
+// TestRollTime splits a batch spanning midnight into the tables of both days, and rolls the
+// logs by the tagged field
+func TestRollTime(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "roll.db")
+	os.Remove(file)
+	c, err := crane.New(def.Config{
+		ServerId:  "server_roll",
+		DataBase:  def.SQLite,
+		DbName:    file,
+		BatchSize: 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	now := time.Now()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.Local)
+	for i := 0; i < 10; i++ {
+		oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+		if i%2 == 0 {
+			oLog.Base.CreateTime = midnight.Unix() - 1
+		}
+		c.Execute(oLog)
+	}
+	lastMonth := midnight.AddDate(0, -1, 0)
+	c.Execute(tradeLog{TradedAt: lastMonth.Unix()})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	b := c.Backend().(*backend.SqlBackend)
+	count := func(tableFullName string) int {
+		var n int
+		if err := b.Db.QueryRow(`SELECT COUNT(*) FROM "` + tableFullName + `"`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	yesterday := utils.GetTableFullNameByTime("log_online", def.RollTypeDay, midnight.AddDate(0, 0, -1))
+	today := utils.GetTableFullNameByTime("log_online", def.RollTypeDay, midnight)
+	if n, m := count(yesterday), count(today); n != 5 || m != 5 {
+		t.Fatalf("%d logs in %s and %d in %s, want 5 each", n, yesterday, m, today)
+	}
+	if n := count(utils.GetTableFullNameByTime("log_trade", def.RollTypeMonth, lastMonth)); n != 1 {
+		t.Fatalf("%d trades in the table of last month", n)
+	}
+	tables, err := c.Tables("log_online", midnight.AddDate(0, 0, -1), midnight.Add(time.Hour))
+	if err != nil || len(tables) != 2 || tables[0].TableFullName != yesterday || tables[1].TableFullName != today {
+		t.Fatalf("tables %+v, error %v", tables, err)
+	}
+}
+
+// TestRollSeasonOrder keeps the tables of the last seasons by when they are recorded rather than
+// by their names, season 10 is after season 9
+func TestRollSeasonOrder(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "season_order.db")
+	os.Remove(file)
+	c, err := crane.New(def.Config{
+		ServerId:        "server_season_order",
+		DataBase:        def.SQLite,
+		DbName:          file,
+		RetentionDryRun: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for season := int32(9); season <= 11; season++ { // recorded in the same second
+		c.Execute(seasonLog{Season: season})
+		if err := c.Flush(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cleaned, err := c.Clean(true); err != nil || len(cleaned) != 1 || cleaned[0] != "log_season_s9" {
+		t.Fatalf("cleaned %q, error %v, want season 9", cleaned, err)
+	}
+}
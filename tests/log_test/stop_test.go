@@ -0,0 +1,162 @@
+package log_test
+
+import (
+	"context"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestStopContext stops a LogCrane before its batches are flushed, all the logs
+// left should be saved with their own save types
+func TestStopContext(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "stop.db")
+	c, err := crane.New(def.Config{
+		ServerId:      "server_stop",
+		DataBase:      def.SQLite,
+		DbName:        file,
+		BatchSize:     1000,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 500; i++ {
+		c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	}
+	for i := 0; i < 100; i++ { // 10 players updated 10 times
+		id := strconv.Itoa(i % 10)
+		c.Execute(logs.NewPlayerInfo(id, id, "server_stop", "location", "cn", int32(i), time.Now().Unix()))
+	}
+	flushed, lost, err := c.StopContext(context.Background())
+	if err != nil || flushed != 600 || lost != 0 {
+		t.Fatalf("flushed %d, lost %d, error %v, want 600 flushed", flushed, lost, err)
+	}
+	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+	checkServerId(t, file, utils.GetTableFullName(oLog, oLog.RollType()), "server_stop", 500)
+	checkServerId(t, file, logs.PlayerInfo{}.TableName(), "server_stop", 10)
+}
+
+// TestStopDeadline stops a LogCrane whose deadline has expired, all the logs left are lost
+func TestStopDeadline(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "deadline.db")
+	c, err := crane.New(def.Config{
+		ServerId:      "server_deadline",
+		DataBase:      def.SQLite,
+		DbName:        file,
+		BatchSize:     1000,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	flushed, lost, err := c.StopContext(ctx)
+	if err != context.Canceled || flushed != 0 || lost != 100 {
+		t.Fatalf("flushed %d, lost %d, error %v, want 100 lost", flushed, lost, err)
+	}
+}
+
+// TestStopBlocked stops a LogCrane whose writes never end before the deadline, it returns
+// at the deadline and counts the logs not saved as lost
+func TestStopBlocked(t *testing.T) {
+	c, fake := newGated(t, def.Config{})
+	defer fake.open()
+	accepted := fill(c, logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	flushed, lost, err := c.StopContext(ctx)
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("StopContext returns in %v, want at the deadline", cost)
+	}
+	if err != context.DeadlineExceeded || flushed != 0 || lost != accepted {
+		t.Fatalf("flushed %d, lost %d, error %v, want %d lost", flushed, lost, err, accepted)
+	}
+}
+
+// TestStopExecuting stops a LogCrane while the logs are being executed, every accepted log is
+// saved by Stop
+func TestStopExecuting(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "stop_executing.db")
+	os.Remove(file)
+	c, err := crane.New(def.Config{
+		ServerId:      "server_stop_executing",
+		DataBase:      def.SQLite,
+		DbName:        file,
+		BatchSize:     100000,
+		FlushInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int64
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.TryExecute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")) {
+				atomic.AddInt64(&accepted, 1)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	flushed, lost, err := c.StopContext(context.Background())
+	wg.Wait()
+	if err != nil || lost != 0 || int64(flushed) != atomic.LoadInt64(&accepted) {
+		t.Fatalf("flushed %d, lost %d, error %v, want %d flushed", flushed, lost, err, accepted)
+	}
+}
+
+// TestStopDeferred stops a LogCrane while the database is down, the logs left are deferred
+// to the backfill file, they are neither saved nor lost and the file is complete after Stop
+func TestStopDeferred(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stop_deferred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFake()
+	fake.setDown(true)
+	c, err := crane.New(def.Config{
+		DataBase:         fake.typ,
+		BatchSize:        1000,
+		FlushInterval:    time.Hour,
+		WriteRetries:     -1,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+		SpillDir:         dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		c.Execute(logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", ""))
+	}
+	flushed, lost, err := c.StopContext(context.Background())
+	if err != nil || flushed != 0 || lost != 0 {
+		t.Fatalf("flushed %d, lost %d, error %v, want none", flushed, lost, err)
+	}
+	if deferred := c.Counters()["log_online"].Deferred; deferred != 10 {
+		t.Fatalf("%d logs deferred, want 10", deferred)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "log_online.backfill"))
+	if lines := strings.Count(string(content), "\n"); err != nil || lines != 10 {
+		t.Fatalf("%d logs in the backfill file, error %v, want 10", lines, err)
+	}
+}
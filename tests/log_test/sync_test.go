@@ -0,0 +1,117 @@
+package log_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/cranewill/logcrane/core"
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestExecuteSync saves logs synchronously from many goroutines, they are batched together
+func TestExecuteSync(t *testing.T) {
+	file := filepath.Join(filepath.Dir(dbFile), "sync.db")
+	os.Remove(file)
+	c, err := crane.New(def.Config{
+		ServerId:      "server_sync",
+		DataBase:      def.SQLite,
+		DbName:        file,
+		BatchSize:     10,
+		FlushInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+	errs := make(chan error, 25)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 25; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- c.ExecuteSync(context.Background(), oLog)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := sql.Open("sqlite3", file+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM \"" + utils.GetTableFullName(oLog, oLog.RollType()) + "\"").Scan(&count)
+	if err != nil || count != 25 {
+		t.Fatalf("%d rows after ExecuteSync, want 25, error %v", count, err)
+	}
+}
+
+// TestExecuteSyncError returns the error of the write, or ctx.Err() if it takes too long
+func TestExecuteSyncError(t *testing.T) {
+	fake := newFake()
+	fake.broken = true
+	c, err := crane.New(def.Config{DataBase: fake.typ, FlushInterval: time.Hour, Tables: map[string]def.TableConfig{
+		"log_online": {SaveType: def.Single},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	if err := c.ExecuteSync(context.Background(), logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")); err == nil {
+		t.Fatal("ExecuteSync returns nil, want insert error")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	pLog := logs.NewPlayerInfo("player", "sdk", "server", "location", "cn", 1, time.Now().Unix())
+	if err := c.ExecuteSync(ctx, pLog); err != context.DeadlineExceeded {
+		t.Fatalf("ExecuteSync returns %v, want deadline exceeded", err)
+	}
+}
+
+// TestExecuteSyncDown returns ErrDeferred rather than nil while the database is down,
+// the log is only written to the backfill file
+func TestExecuteSyncDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync_down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := newFake()
+	fake.setDown(true)
+	c, err := crane.New(def.Config{
+		DataBase:         fake.typ,
+		FlushInterval:    20 * time.Millisecond,
+		WriteRetries:     -1,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+		SpillDir:         dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ { // the first write opens the breaker, the second one skips the database
+		if err := c.ExecuteSync(ctx, logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")); err != core.ErrDeferred {
+			t.Fatalf("ExecuteSync returns %v while the database is down, want ErrDeferred", err)
+		}
+	}
+	if deferred := c.Counters()["log_online"].Deferred; deferred != 2 {
+		t.Fatalf("%d logs deferred, want 2", deferred)
+	}
+}
@@ -0,0 +1,169 @@
+package log_test
+
+import (
+	"github.com/cranewill/logcrane/crane"
+	"github.com/cranewill/logcrane/def"
+	"github.com/cranewill/logcrane/logs"
+	"github.com/cranewill/logcrane/utils"
+	"github.com/cranewill/logcrane/wal"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWalReplay keeps the logs failed to save transiently in the write-ahead log, and saves them after restarted
+func TestWalReplay(t *testing.T) {
+	dir := filepath.Join(filepath.Dir(dbFile), "wal")
+	fake := newFake()
+	fake.flaky = math.MaxInt32
+	c, err := crane.New(def.Config{
+		DataBase:         fake.typ,
+		WalDir:           dir,
+		BatchSize:        10,
+		FlushInterval:    20 * time.Millisecond,
+		WriteRetries:     -1,
+		BreakerThreshold: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oLog := logs.NewOnlineLog("TestPlayerId", "source", "127.0.0.1", "")
+	for i := 0; i < 30; i++ {
+		c.Execute(oLog)
+	}
+	for i := 0; i < 10; i++ {
+		c.Execute(logs.NewPlayerInfo("player", "sdk", "server_wal", "location", "cn", int32(i), time.Now().Unix()))
+	}
+	c.Stop()
+
+	file := filepath.Join(filepath.Dir(dbFile), "wal.db")
+	c, err = crane.New(def.Config{
+		ServerId:      "server_wal",
+		DataBase:      def.SQLite,
+		DbName:        file,
+		FlushInterval: 20 * time.Millisecond,
+		WalDir:        dir,
+		Logs:          []def.Logger{logs.OnlineLog{}, logs.PlayerInfo{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkServerId(t, file, utils.GetTableFullName(oLog, oLog.RollType()), "server_wal", 30)
+	checkServerId(t, file, logs.PlayerInfo{}.TableName(), "server_wal", 1)
+	c.Stop()
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*"+wal.SegmentExt)); len(segments) != 0 {
+		t.Fatalf("%d segments left after all the logs saved", len(segments))
+	}
+}
+
+// TestWal acknowledges, detects the corrupted records and caps the size of the write-ahead log
+func TestWal(t *testing.T) {
+	dir, err := ioutil.TempDir(filepath.Dir(dbFile), "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, records, err := wal.Open(dir, wal.Options{})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("open empty wal returns %d records, error %v", len(records), err)
+	}
+	for _, data := range []string{"a", "b", "c", "d"} {
+		if _, err := w.Append([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Ack(1, 3); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	w, records, err = wal.Open(dir, wal.Options{})
+	if err != nil || len(records) != 2 || string(records[0].Data) != "b" || records[1].Seq != 4 {
+		t.Fatalf("reopen returns %v, error %v, want b and d", records, err)
+	}
+	w.Close()
+
+	// corrupt the last record
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+wal.SegmentExt))
+	content, _ := ioutil.ReadFile(segments[0])
+	content[len(content)-1] ^= 0xff
+	ioutil.WriteFile(segments[0], content, 0644)
+	if records, err := wal.ReadSegment(segments[0]); len(records) != 3 {
+		t.Fatalf("read corrupted segment returns %d records, want 3", len(records))
+	} else if _, corrupted := err.(*wal.CorruptError); !corrupted {
+		t.Fatalf("read corrupted segment returns %v", err)
+	}
+	w, records, err = wal.Open(dir, wal.Options{})
+	if err != nil || len(records) != 1 || string(records[0].Data) != "b" {
+		t.Fatalf("open corrupted wal returns %v, error %v, want b", records, err)
+	}
+	w.Ack(records[0].Seq)
+	w.Close()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("%d files left after all the records acknowledged", len(files))
+	}
+
+	w, _, _ = wal.Open(dir, wal.Options{SegmentSize: 100, MaxSize: 200})
+	full := false
+	for i := 0; i < 20 && !full; i++ {
+		_, err = w.Append(make([]byte, 20))
+		full = err == wal.ErrFull
+	}
+	if !full {
+		t.Fatal("wal never full")
+	}
+	w.Close()
+	os.RemoveAll(dir)
+	w, _, _ = wal.Open(dir, wal.Options{SegmentSize: 100, MaxSize: 200, DeleteOldest: true})
+	for i := 0; i < 20; i++ {
+		if _, err = w.Append(make([]byte, 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size := w.Size(); size > 200 {
+		t.Fatalf("wal size %d, want no more than 200", size)
+	}
+	w.Close()
+}
+
+// TestWalCorrupt moves the records of the write-ahead log failed to decode to the corrupt file,
+// and acknowledges them so they are not replayed again
+func TestWalCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wal_corrupt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	walDir := filepath.Join(dir, "wal")
+	w, _, err := wal.Open(walDir, wal.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Append([]byte("garbage"))
+	w.Append([]byte(`{"table":"log_online","log":{"base":"garbage"}}`))
+	w.Close()
+	c, err := crane.New(def.Config{
+		ServerId:      "server_wal_corrupt",
+		DataBase:      def.SQLite,
+		DbName:        filepath.Join(dir, "corrupt.db"),
+		FlushInterval: 20 * time.Millisecond,
+		WalDir:        walDir,
+		DeadLetterDir: filepath.Join(dir, "dead_letter"),
+		Logs:          []def.Logger{logs.OnlineLog{}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Stop()
+	w, records, err := wal.Open(walDir, wal.Options{})
+	if err != nil || len(records) != 0 {
+		t.Fatalf("%d records left in the write-ahead log, error %v, want 0", len(records), err)
+	}
+	w.Close()
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dead_letter", "corrupt_wal.jsonl"))
+	if lines := strings.Count(string(content), "\n"); err != nil || lines != 2 {
+		t.Fatalf("%d corrupt records moved, error %v, want 2", lines, err)
+	}
+}
@@ -0,0 +1,319 @@
+package utils
+
+import (
+	"container/list"
+	"github.com/cranewill/logcrane/def"
+	"strconv"
+	"strings"
+)
+
+// Dialect defines how a kind of sql database writes the statements of the logs
+type Dialect interface {
+	Quote(name string) string                                      // quote an identifier
+	ColumnType(field def.ColumnDef) string                         // the column type of the field
+	AutoIncrementColumn(field def.ColumnDef) string                // the column definition of the 'pk_id' field
+	InlineIndex() bool                                             // whether the indexes are declared inside CREATE TABLE
+	TableOptions() string                                          // the options after CREATE TABLE (...)
+	Placeholder(i int) string                                      // the placeholder of the i-th argument, i starts from 1
+	UpsertClause(primary string, columns []string) string          // the clause after INSERT to update the conflict rows
+	ModifyColumn(tableFullName string, field def.ColumnDef) string // the statement changing the column type, empty if not supported
+	ArchiveTable(tableFullName, schema string) string              // the statement moving the table into the schema
+}
+
+// MysqlDialect writes mysql statements
+type MysqlDialect struct{}
+
+func (d MysqlDialect) Quote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+func (d MysqlDialect) ColumnType(field def.ColumnDef) string {
+	typ := field.Type
+	if strings.ToLower(field.Type) == def.VARCHAR || strings.ToLower(field.Type) == def.TEXT {
+		if field.Length <= 0 {
+			field.Length = 255
+		}
+		typ += "(" + strconv.Itoa(int(field.Length)) + ")"
+	}
+	return typ
+}
+
+func (d MysqlDialect) AutoIncrementColumn(field def.ColumnDef) string {
+	return d.Quote(field.Name) + " " + d.ColumnType(field) + " AUTO_INCREMENT"
+}
+
+func (d MysqlDialect) InlineIndex() bool {
+	return true
+}
+
+func (d MysqlDialect) TableOptions() string {
+	return " ENGINE=InnoDB DEFAULT CHARSET=utf8mb4"
+}
+
+func (d MysqlDialect) Placeholder(i int) string {
+	return "?"
+}
+
+func (d MysqlDialect) UpsertClause(primary string, columns []string) string {
+	sets := make([]string, 0, len(columns))
+	for _, column := range columns {
+		sets = append(sets, d.Quote(column)+"=VALUES("+d.Quote(column)+")")
+	}
+	return " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ",")
+}
+
+func (d MysqlDialect) ModifyColumn(tableFullName string, field def.ColumnDef) string {
+	return "ALTER TABLE " + d.Quote(tableFullName) + " MODIFY COLUMN " + d.Quote(field.Name) + " " + d.ColumnType(field) + ";"
+}
+
+func (d MysqlDialect) ArchiveTable(tableFullName, schema string) string {
+	return "RENAME TABLE " + d.Quote(tableFullName) + " TO " + d.Quote(schema) + "." + d.Quote(tableFullName) + ";"
+}
+
+// SqliteDialect writes sqlite statements
+type SqliteDialect struct{}
+
+func (d SqliteDialect) Quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func (d SqliteDialect) ColumnType(field def.ColumnDef) string {
+	switch strings.ToLower(field.Type) {
+	case def.TINY_INT, def.SMALL_INT, def.MEDIUMINT, def.INT, def.BIG_INT:
+		return "INTEGER"
+	case def.FLOAT, def.DOUBLE:
+		return "REAL"
+	default:
+		return "TEXT"
+	}
+}
+
+// AutoIncrementColumn returns an INTEGER column, which becomes an alias of
+// the rowid when it is declared as the primary key
+func (d SqliteDialect) AutoIncrementColumn(field def.ColumnDef) string {
+	return d.Quote(field.Name) + " INTEGER"
+}
+
+func (d SqliteDialect) InlineIndex() bool {
+	return false
+}
+
+func (d SqliteDialect) TableOptions() string {
+	return ""
+}
+
+func (d SqliteDialect) Placeholder(i int) string {
+	return "?"
+}
+
+func (d SqliteDialect) UpsertClause(primary string, columns []string) string {
+	return onConflictClause(d, primary, columns)
+}
+
+// ModifyColumn returns nothing, sqlite can not change the column types. The columns
+// of sqlite keep any values, so they never need widening
+func (d SqliteDialect) ModifyColumn(tableFullName string, field def.ColumnDef) string {
+	return ""
+}
+
+// ArchiveTable renames the table with the schema as its prefix, the tables of sqlite can
+// not be moved into an attached database
+func (d SqliteDialect) ArchiveTable(tableFullName, schema string) string {
+	return "ALTER TABLE " + d.Quote(tableFullName) + " RENAME TO " + d.Quote(schema+"_"+tableFullName) + ";"
+}
+
+// PostgresDialect writes postgresql statements
+type PostgresDialect struct{}
+
+func (d PostgresDialect) Quote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func (d PostgresDialect) ColumnType(field def.ColumnDef) string {
+	length := field.Length
+	if length <= 0 {
+		length = 255
+	}
+	switch strings.ToLower(field.Type) {
+	case def.TINY_INT, def.SMALL_INT:
+		return "SMALLINT"
+	case def.MEDIUMINT, def.INT:
+		return "INTEGER"
+	case def.BIG_INT:
+		return "BIGINT"
+	case def.FLOAT:
+		return "REAL"
+	case def.DOUBLE:
+		return "DOUBLE PRECISION"
+	case def.DATE:
+		return "DATE"
+	case def.TIME:
+		return "TIME"
+	case def.DATETIME, def.TIMESTAMP:
+		return "TIMESTAMP"
+	case def.CHAR:
+		return "CHAR(" + strconv.Itoa(int(length)) + ")"
+	case def.VARCHAR:
+		return "VARCHAR(" + strconv.Itoa(int(length)) + ")"
+	default:
+		return "TEXT"
+	}
+}
+
+func (d PostgresDialect) AutoIncrementColumn(field def.ColumnDef) string {
+	if strings.ToLower(field.Type) == def.BIG_INT {
+		return d.Quote(field.Name) + " BIGSERIAL"
+	}
+	return d.Quote(field.Name) + " SERIAL"
+}
+
+func (d PostgresDialect) InlineIndex() bool {
+	return false
+}
+
+func (d PostgresDialect) TableOptions() string {
+	return ""
+}
+
+func (d PostgresDialect) Placeholder(i int) string {
+	return "$" + strconv.Itoa(i)
+}
+
+func (d PostgresDialect) UpsertClause(primary string, columns []string) string {
+	return onConflictClause(d, primary, columns)
+}
+
+func (d PostgresDialect) ModifyColumn(tableFullName string, field def.ColumnDef) string {
+	return "ALTER TABLE " + d.Quote(tableFullName) + " ALTER COLUMN " + d.Quote(field.Name) + " TYPE " + d.ColumnType(field) + ";"
+}
+
+func (d PostgresDialect) ArchiveTable(tableFullName, schema string) string {
+	return "ALTER TABLE " + d.Quote(tableFullName) + " SET SCHEMA " + d.Quote(schema) + ";"
+}
+
+// onConflictClause returns the standard ON CONFLICT clause. It returns nothing if there is no primary key
+func onConflictClause(d Dialect, primary string, columns []string) string {
+	if primary == "" {
+		return ""
+	}
+	sets := make([]string, 0, len(columns))
+	for _, column := range columns {
+		sets = append(sets, d.Quote(column)+" = EXCLUDED."+d.Quote(column))
+	}
+	return " ON CONFLICT (" + d.Quote(primary) + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// GetCreateSqls returns the CREATE TABLE statement of the log in the dialect. If the dialect
+// does not declare indexes inside the table, the CREATE INDEX statements follow it.
+// Index names are prefixed with the table name in that case, because they are
+// unique in the whole database
+func GetCreateSqls(d Dialect, log def.Logger, tableFullName string) []string {
+	fields := GetFields(log, true)
+	primary, indexNames, indexes := GetKeys(fields)
+	columns := make([]string, 0, len(fields)+len(indexNames)+1)
+	var createTimeTemp, saveTimeTemp, actionIdTemp string
+	for _, field := range fields {
+		column := d.Quote(field.Name) + " " + d.ColumnType(field)
+		switch strings.ToLower(field.Name) {
+		case def.NamePkId:
+			column = d.AutoIncrementColumn(field)
+		case def.NameCreateTime:
+			createTimeTemp = column
+			continue
+		case def.NameSaveTime:
+			saveTimeTemp = column
+			continue
+		case def.NameActionId:
+			actionIdTemp = column
+			continue
+		}
+		columns = append(columns, column)
+	}
+	for _, column := range []string{createTimeTemp, saveTimeTemp, actionIdTemp} {
+		if column != "" {
+			columns = append(columns, column)
+		}
+	}
+	if primary != "" {
+		columns = append(columns, "PRIMARY KEY ("+d.Quote(primary)+")")
+	}
+	var indexSqls []string
+	for _, name := range indexNames {
+		if d.InlineIndex() {
+			columns = append(columns, "KEY "+d.Quote(name)+" ("+quoteColumns(d, indexes[name], ",")+")")
+		} else {
+			indexSqls = append(indexSqls, indexSql(d, tableFullName, name, indexes[name]))
+		}
+	}
+	createSql := "CREATE TABLE IF NOT EXISTS " + d.Quote(tableFullName) + "\n (" + strings.Join(columns, ",\n") + "\n)" + d.TableOptions() + ";"
+	return append([]string{createSql}, indexSqls...)
+}
+
+// indexSql returns the CREATE INDEX statement of the dialects which do not declare indexes inside the table
+func indexSql(d Dialect, tableFullName, name string, columns []string) string {
+	return "CREATE INDEX IF NOT EXISTS " + d.Quote(tableFullName+"_"+name) + " ON " + d.Quote(tableFullName) +
+		" (" + quoteColumns(d, columns, ", ") + ");"
+}
+
+// GetInsertSqlAndArgs returns the INSERT statement of the logs with placeholders, and
+// the arguments of it. The 'pk_id' column is left to the database
+func GetInsertSqlAndArgs(d Dialect, logs *list.List, tableFullName string) (string, []interface{}) {
+	var columns []string
+	rows := make([]string, 0, logs.Len())
+	args := make([]interface{}, 0)
+	for e := logs.Front(); e != nil; e = e.Next() {
+		columns = columns[:0]
+		placeholders := make([]string, 0)
+		for _, field := range GetFields(e.Value.(def.Logger), false) {
+			if strings.ToLower(field.Name) == def.NamePkId {
+				continue
+			}
+			columns = append(columns, field.Name)
+			args = append(args, GetTypedValue(field))
+			placeholders = append(placeholders, d.Placeholder(len(args)))
+		}
+		rows = append(rows, "("+strings.Join(placeholders, ",")+")")
+	}
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, d.Quote(column))
+	}
+	return "INSERT INTO " + d.Quote(tableFullName) + " (" + strings.Join(quoted, ",") + ") VALUES " + strings.Join(rows, ","), args
+}
+
+// GetUpsertSqlAndArgs returns the INSERT statement which updates the conflict rows, and the
+// arguments of it. If more than one log have the same primary key, only the last one is kept
+func GetUpsertSqlAndArgs(d Dialect, logs *list.List, tableFullName string) (string, []interface{}) {
+	fields := GetFields(logs.Front().Value.(def.Logger), true)
+	primary, _, _ := GetKeys(fields)
+	columns := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if strings.ToLower(field.Name) != def.NamePkId {
+			columns = append(columns, field.Name)
+		}
+	}
+	unique := logs
+	if primary != "" && strings.ToLower(primary) != def.NamePkId {
+		unique = list.New()
+		last := make(map[string]*list.Element)
+		for e := logs.Front(); e != nil; e = e.Next() {
+			key := GetPrimaryValue(e.Value.(def.Logger), primary)
+			if old, exist := last[key]; exist {
+				unique.Remove(old)
+			}
+			last[key] = unique.PushBack(e.Value)
+		}
+	}
+	stmt, args := GetInsertSqlAndArgs(d, unique, tableFullName)
+	return stmt + d.UpsertClause(primary, columns), args
+}
+
+// GetPrimaryValue returns the value of the primary key column of the log
+func GetPrimaryValue(log def.Logger, primary string) string {
+	for _, field := range GetFields(log, false) {
+		if field.Name == primary {
+			return field.Value
+		}
+	}
+	return ""
+}
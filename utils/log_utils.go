@@ -3,41 +3,304 @@ package utils
 
 import (
 	"container/list"
+	"crypto/sha1"
 	"fmt"
 	"github.com/cranewill/logcrane/def"
 	log2 "log"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var LogFieldsDefinitions map[string][]def.ColumnDef
+var logFieldsMu sync.RWMutex // guards LogFieldsDefinitions, workers of different tables read it concurrently
+
+var columnPaths map[columnKey][]int // field index paths of the columns, nil if not exists
+var columnPathsMu sync.RWMutex
+
+// columnKey is a column of a log type
+type columnKey struct {
+	typ    reflect.Type
+	column string
+}
 
 func init() {
 	LogFieldsDefinitions = make(map[string][]def.ColumnDef)
+	columnPaths = make(map[columnKey][]int)
+}
+
+// SetServerId returns a copy of the log whose 'server_id' column is set to serverId.
+// The log is returned unchanged if it has no string 'server_id' column
+func SetServerId(log def.Logger, serverId string) def.Logger {
+	typ := reflect.TypeOf(log)
+	if typ.Kind() != reflect.Struct {
+		return log
+	}
+	path := getColumnPath(typ, def.NameServerId, reflect.String)
+	if path == nil {
+		return log
+	}
+	val := reflect.New(typ).Elem()
+	val.Set(reflect.ValueOf(log))
+	val.FieldByIndex(path).SetString(serverId)
+	return val.Interface().(def.Logger)
+}
+
+// GetCreateTime returns the int64 'create_time' column of the log, the unix seconds when it
+// was created. It returns 0 if the log has no such column
+func GetCreateTime(log def.Logger) int64 {
+	return getTime(log, def.NameCreateTime)
+}
+
+// GetRollTime returns the time which the table of the log is rolled by: the int64 unix seconds
+// of the field tagged `roll:"true"`, or the 'create_time' column. It returns the current time
+// if the log has neither of them or it is not set
+func GetRollTime(log def.Logger) time.Time {
+	if t := getTime(log, rollColumn); t > 0 {
+		return time.Unix(t, 0)
+	}
+	if t := getTime(log, def.NameCreateTime); t > 0 {
+		return time.Unix(t, 0)
+	}
+	return time.Now()
+}
+
+// rollColumn is the key of the field tagged `roll:"true"` in the cached column paths
+const rollColumn = "roll:"
+
+// getTime returns the int64 column of the log, 0 if the log has no such column
+func getTime(log def.Logger, column string) int64 {
+	val := reflect.ValueOf(log)
+	if val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return 0
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return 0
+	}
+	path := getColumnPath(val.Type(), column, reflect.Int64)
+	if path == nil {
+		return 0
+	}
+	return val.FieldByIndex(path).Int()
+}
+
+// getColumnPath returns the cached field index path of the column of the kind in the log type
+func getColumnPath(typ reflect.Type, column string, kind reflect.Kind) []int {
+	key := columnKey{typ: typ, column: column}
+	columnPathsMu.RLock()
+	path, exist := columnPaths[key]
+	columnPathsMu.RUnlock()
+	if !exist {
+		path = findColumnPath(typ, column, kind)
+		columnPathsMu.Lock()
+		columnPaths[key] = path
+		columnPathsMu.Unlock()
+	}
+	return path
 }
 
-// GetTableFullNameByTableName returns the DB table name of the specific log name
+// findColumnPath returns the field index path of the column in the same order as
+// GetFieldDefs, or nil if there is no settable one of the kind
+func findColumnPath(typ reflect.Type, column string, kind reflect.Kind) []int {
+	for i := 0; i < typ.NumField(); i++ {
+		fTyp := typ.Field(i)
+		if fTyp.PkgPath != "" { // unexported
+			continue
+		}
+		if fTyp.Type.Kind() == reflect.Struct {
+			if path := findColumnPath(fTyp.Type, column, kind); path != nil {
+				return append([]int{i}, path...)
+			}
+			continue
+		}
+		name, ok := fTyp.Tag.Lookup("name")
+		if !ok {
+			name = strings.ToLower(fTyp.Name)
+		}
+		if column == rollColumn {
+			name = ""
+			if fTyp.Tag.Get("roll") == "true" {
+				name = rollColumn
+			}
+		}
+		if strings.ToLower(name) == column && fTyp.Type.Kind() == kind {
+			return []int{i}
+		}
+	}
+	return nil
+}
+
+// GetTableFullNameByTableName returns the DB table name of the specific log name at the current time
 func GetTableFullNameByTableName(tableName string, rollType int32) string {
-	year, month, day := time.Now().Date()
+	return GetTableFullNameByTime(tableName, rollType, time.Now())
+}
+
+// GetTableFullNameByTime returns the DB table name of the specific log name at the time.
+// The tables of def.RollTypeCustom are named by the logs, see GetLogTableFullName
+func GetTableFullNameByTime(tableName string, rollType int32, t time.Time) string {
+	year, month, day := t.Date()
 	var timeStr string
 	switch rollType {
-	case def.Never:
-		return tableName
+	case def.RollTypeHour:
+		timeStr = strconv.Itoa(year*1000000 + int(month)*10000 + day*100 + t.Hour())
+	case def.RollTypeWeek:
+		year, week := t.ISOWeek()
+		timeStr = fmt.Sprintf("%dw%02d", year, week)
 	case def.RollTypeDay:
 		timeStr = strconv.Itoa(year*10000 + int(month)*100 + day)
 	case def.RollTypeMonth:
 		timeStr = strconv.Itoa(year*100 + int(month))
 	case def.RollTypeYear:
 		timeStr = strconv.Itoa(year)
+	default:
+		return tableName
 	}
 	return tableName + "_" + timeStr
 }
 
-// GetTableFullName returns the DB table name of the specific log name
+// GetLogTableFullName returns the DB table name of the log rolled at the time, or by its
+// def.Roller if the roll type is def.RollTypeCustom
+func GetLogTableFullName(log def.Logger, rollType int32, t time.Time) string {
+	if rollType != def.RollTypeCustom {
+		return GetTableFullNameByTime(log.TableName(), rollType, t)
+	}
+	if roller, ok := log.(def.Roller); ok {
+		if suffix := roller.TableSuffix(); suffix != "" {
+			return log.TableName() + "_" + suffix
+		}
+	}
+	return log.TableName()
+}
+
+// GetPeriod returns the period of the rolled table at the time in unix seconds, [start, end).
+// It returns 0, 0 for def.Never and def.RollTypeCustom, the table keeps the logs of all time
+func GetPeriod(rollType int32, t time.Time) (start, end int64) {
+	year, month, day := t.Date()
+	var from, to time.Time
+	switch rollType {
+	case def.RollTypeHour:
+		from = time.Date(year, month, day, t.Hour(), 0, 0, 0, t.Location())
+		to = time.Date(year, month, day, t.Hour()+1, 0, 0, 0, t.Location())
+	case def.RollTypeWeek:
+		from = time.Date(year, month, day-(int(t.Weekday())+6)%7, 0, 0, 0, 0, t.Location())
+		to = from.AddDate(0, 0, 7)
+	case def.RollTypeDay:
+		from = time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+		to = from.AddDate(0, 0, 1)
+	case def.RollTypeMonth:
+		from = time.Date(year, month, 1, 0, 0, 0, 0, t.Location())
+		to = from.AddDate(0, 1, 0)
+	case def.RollTypeYear:
+		from = time.Date(year, 1, 1, 0, 0, 0, 0, t.Location())
+		to = from.AddDate(1, 0, 0)
+	default:
+		return 0, 0
+	}
+	return from.Unix(), to.Unix()
+}
+
+// GetExpiry returns the start of the oldest period kept when keep periods are kept at the time,
+// the rolled tables ending before it are expired. It returns 0 for def.Never and def.RollTypeCustom
+func GetExpiry(rollType int32, keep int, t time.Time) int64 {
+	start, _ := GetPeriod(rollType, t)
+	if start == 0 {
+		return 0
+	}
+	from := time.Unix(start, 0).In(t.Location())
+	back := 1 - keep
+	switch rollType {
+	case def.RollTypeHour:
+		from = time.Date(from.Year(), from.Month(), from.Day(), from.Hour()+back, 0, 0, 0, from.Location())
+	case def.RollTypeWeek:
+		from = from.AddDate(0, 0, 7*back)
+	case def.RollTypeDay:
+		from = from.AddDate(0, 0, back)
+	case def.RollTypeMonth:
+		from = from.AddDate(0, back, 0)
+	case def.RollTypeYear:
+		from = from.AddDate(back, 0, 0)
+	}
+	return from.Unix()
+}
+
+// ParseTableTime returns the start of the period of the rolled table by its name in local time.
+// It returns false if the name is not a rolled table name of the log
+func ParseTableTime(tableName, tableFullName string, rollType int32) (time.Time, bool) {
+	var layout string
+	switch rollType {
+	case def.RollTypeHour:
+		layout = "2006010215"
+	case def.RollTypeWeek:
+		layout = "2006w01"
+	case def.RollTypeDay:
+		layout = "20060102"
+	case def.RollTypeMonth:
+		layout = "200601"
+	case def.RollTypeYear:
+		layout = "2006"
+	default:
+		return time.Time{}, false
+	}
+	if !strings.HasPrefix(tableFullName, tableName+"_") {
+		return time.Time{}, false
+	}
+	suffix := tableFullName[len(tableName)+1:]
+	if len(suffix) != len(layout) {
+		return time.Time{}, false
+	}
+	if rollType == def.RollTypeWeek {
+		return parseWeek(suffix)
+	}
+	t, err := time.ParseInLocation(layout, suffix, time.Local)
+	return t, err == nil
+}
+
+// parseWeek returns the Monday of the ISO week like "2026w42" in local time
+func parseWeek(suffix string) (time.Time, bool) {
+	year, err := strconv.Atoi(suffix[:4])
+	if err != nil || suffix[4] != 'w' {
+		return time.Time{}, false
+	}
+	week, err := strconv.Atoi(suffix[5:])
+	if err != nil || week < 1 || week > 53 {
+		return time.Time{}, false
+	}
+	// January 4th is always in the first week
+	jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, time.Local)
+	monday := jan4.AddDate(0, 0, 7*(week-1)-(int(jan4.Weekday())+6)%7)
+	if y, _ := monday.ISOWeek(); y != year {
+		return time.Time{}, false
+	}
+	return monday, true
+}
+
+// GetSchema returns the column set of the log like "name varchar(255) key:name_idx, level int",
+// and its sha1 hash which changes when any column changes
+func GetSchema(log def.Logger) (hash, columns string) {
+	fields := GetFields(log, true)
+	parts := make([]string, 0, len(fields))
+	for _, field := range fields {
+		part := field.Name + " " + strings.ToLower(field.Type)
+		if field.Length > 0 {
+			part += "(" + strconv.Itoa(int(field.Length)) + ")"
+		}
+		if field.Index != "" {
+			part += " key:" + field.Index
+		}
+		parts = append(parts, part)
+	}
+	columns = strings.Join(parts, ", ")
+	return fmt.Sprintf("%x", sha1.Sum([]byte(columns))), columns
+}
+
+// GetTableFullName returns the DB table name of the log, rolled by its GetRollTime or its def.Roller
 func GetTableFullName(log def.Logger, rollType int32) string {
-	return GetTableFullNameByTableName(log.TableName(), rollType)
+	return GetLogTableFullName(log, rollType, GetRollTime(log))
 }
 
 // GetFields returns a slice contains logs's every attributes table column def from memory.
@@ -47,11 +310,16 @@ func GetFields(log interface{}, onlyDef bool) []def.ColumnDef {
 	typ := reflect.TypeOf(log)
 	logName := typ.Name()
 	if onlyDef {
-		_, exist := LogFieldsDefinitions[logName]
+		logFieldsMu.RLock()
+		fields, exist := LogFieldsDefinitions[logName]
+		logFieldsMu.RUnlock()
 		if !exist {
-			LogFieldsDefinitions[logName] = GetFieldDefs(log, true)
+			fields = GetFieldDefs(log, true)
+			logFieldsMu.Lock()
+			LogFieldsDefinitions[logName] = fields
+			logFieldsMu.Unlock()
 		}
-		return LogFieldsDefinitions[logName]
+		return fields
 	} else {
 		return GetFieldDefs(log, false)
 	}
@@ -94,8 +362,6 @@ func GetFieldDefs(log interface{}, onlyDef bool) []def.ColumnDef {
 			switch strings.ToLower(field.Name) { // field value
 			case def.NamePkId:
 				break
-			case def.NameServerId:
-				field.Value = def.ServerId
 			case def.NameSaveTime:
 				field.Value = strconv.FormatInt(time.Now().Unix(), 10)
 			default:
@@ -150,67 +416,14 @@ func GetFieldDefString(fieldDef def.ColumnDef) string {
 // GetNewCreateSql is the new create sql statement function. It allows you
 // to customize primary key and normal key (Attention: If there has been 'pk_id'
 // column, it will use 'pk_id' as primary key).
+// It returns the mysql statement, use GetCreateSqls for the other databases
 func GetNewCreateSql(log def.Logger) string {
-	sqlFormer := "CREATE TABLE IF NOT EXISTS `%s`\n "
-	sqlValue := "( %s "
-	sqlTail := "%s) ENGINE=InnoDB DEFAULT CHARSET=utf8;"
-	havePkId := false
-	combinedKeys := make(map[string][]string)
-	var fieldsStr, indexStr, pkIdStr string
-	var createTimeTemp, saveTimeTemp, actionIdTemp string
-	fields := GetFields(log, true)
-	for i := 0; i < len(fields); i++ {
-		field := fields[i]
-		fieldStr := GetFieldDefString(field)
-		if strings.ToLower(field.Name) == def.NamePkId {
-			pkIdStr = "PRIMARY KEY (`" + field.Name + "`),\n"
-			havePkId = true
-		}
-		if strings.ToLower(field.Name) == def.NameCreateTime {
-			createTimeTemp = fieldStr
-			continue
-		}
-		if strings.ToLower(field.Name) == def.NameSaveTime {
-			saveTimeTemp = fieldStr
-			continue
-		}
-		if strings.ToLower(field.Name) == def.NameActionId {
-			actionIdTemp = fieldStr
-			continue
-		}
-		if field.Index != "" {
-			keys := strings.Split(field.Index, ",")
-			for _, key := range keys {
-				if !havePkId && key == def.IndexTypePK {
-					pkIdStr = "PRIMARY KEY (`" + field.Name + "`),\n"
-				} else {
-					if key == def.IndexTypePK {
-						continue
-					}
-					combinedKeys[key] = append(combinedKeys[key], field.Name)
-				}
-			}
-		}
-		fieldsStr += fieldStr
-	}
-	for key, fields := range combinedKeys {
-		indexStr += "KEY `" + key + "` ("
-		for _, field := range fields {
-			indexStr += "`" + field + "`,"
-		}
-		indexStr = strings.TrimSuffix(indexStr, ",")
-		indexStr += "),\n"
-	}
-	fieldsStr += createTimeTemp + saveTimeTemp + actionIdTemp
-	indexStr = pkIdStr + indexStr
-	indexStr = strings.TrimSuffix(indexStr, ",\n")
-	if indexStr == "" {
-		fieldsStr = strings.TrimSuffix(fieldsStr, ",\n")
-	}
-	return sqlFormer + fmt.Sprintf(sqlValue, fieldsStr) + fmt.Sprintf(sqlTail, indexStr)
+	return GetCreateSqls(MysqlDialect{}, log, "%s")[0]
 }
 
 // GetInsertSql returns the INSERT sql prepared statement of the logs
+//
+// Deprecated: use GetInsertSqlAndArgs, which passes the values as arguments
 func GetInsertSql(log def.Logger) string {
 	sqlFormer := "INSERT INTO `%s`"
 	sqlBack := "( %s ) VALUES "
@@ -230,6 +443,8 @@ func GetInsertSql(log def.Logger) string {
 }
 
 // GetBatchInsertSql returns former part of INSERT sql prepared statement
+//
+// Deprecated: use GetInsertSqlAndArgs, which passes the values as arguments
 func GetBatchInsertSql(log def.Logger) string {
 	sqlHead := "INSERT INTO `%s`"
 	sqlBack := "( %s ) VALUES "
@@ -249,6 +464,9 @@ func GetBatchInsertSql(log def.Logger) string {
 }
 
 // GetInsertValues returns the string values in batch insert sql
+//
+// Deprecated: the values are not escaped, a quote in them breaks the statement.
+// Use GetInsertSqlAndArgs, which passes the values as arguments
 func GetInsertValues(log def.Logger) string {
 	fields := GetFieldDefs(log, false)
 	valueStrList := make([]string, 0)
@@ -267,6 +485,9 @@ func GetInsertValues(log def.Logger) string {
 }
 
 // GetUpdateSql returns the update sql statement
+//
+// Deprecated: the values are not escaped, a quote in them breaks the statement.
+// Use GetUpsertSqlAndArgs, which passes the values as arguments
 func GetUpdateSql(logs *list.List) string {
 	sqlHead := "INSERT INTO `%s`"
 	sqlBack := "( %s ) VALUES "
@@ -301,3 +522,63 @@ func GetUpdateSql(logs *list.List) string {
 	}
 	return sqlHead
 }
+
+// GetTypedValue returns the value of the field in the go type matching its column type,
+// integer columns return int64, float columns return float64 and the others return string.
+// If the value can not be converted, it returns nil
+func GetTypedValue(field def.ColumnDef) interface{} {
+	switch strings.ToLower(field.Type) {
+	case def.TINY_INT, def.SMALL_INT, def.MEDIUMINT, def.INT, def.BIG_INT:
+		if v, err := strconv.ParseInt(field.Value, 10, 64); err == nil {
+			return v
+		}
+		if v, err := strconv.ParseBool(field.Value); err == nil { // bool values are saved as 0 or 1
+			if v {
+				return int64(1)
+			}
+			return int64(0)
+		}
+		return nil
+	case def.FLOAT, def.DOUBLE:
+		if v, err := strconv.ParseFloat(field.Value, 64); err == nil {
+			return v
+		}
+		return nil
+	default:
+		return field.Value
+	}
+}
+
+// GetKeys returns the primary key column and the indexes defined by the 'key' tags of fields.
+// If there is 'pk_id' column, it will be used as the primary key. The index names are
+// returned in the order they first appear, and indexes maps index name to its columns
+func GetKeys(fields []def.ColumnDef) (primary string, indexNames []string, indexes map[string][]string) {
+	indexes = make(map[string][]string)
+	for _, field := range fields {
+		if strings.ToLower(field.Name) == def.NamePkId {
+			primary = field.Name
+		}
+	}
+	for _, field := range fields {
+		if field.Index == "" {
+			continue
+		}
+		for _, key := range strings.Split(field.Index, ",") {
+			key = strings.TrimSpace(key)
+			if key == "" {
+				continue
+			}
+			if key == def.IndexTypePK {
+				if primary == "" {
+					primary = field.Name
+				}
+				continue
+			}
+			if _, exist := indexes[key]; !exist {
+				indexNames = append(indexNames, key)
+			}
+			indexes[key] = append(indexes[key], field.Name)
+		}
+	}
+	return
+}
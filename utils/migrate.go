@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"github.com/cranewill/logcrane/def"
+	"strconv"
+	"strings"
+)
+
+// Migration is the changes making an existing table fit its log struct
+type Migration struct {
+	Table   string   // the table full name
+	Sqls    []string // the statements of the changes to apply
+	Changes []string // the changes to apply
+	Refused []string // the destructive changes not allowed
+}
+
+// widths of the integer and the float column types, a column can be widened to a wider type of its family
+var (
+	intWidths   = map[string]int{"TINYINT": 1, "SMALLINT": 2, "MEDIUMINT": 3, "INT": 4, "INTEGER": 4, "BIGINT": 8}
+	floatWidths = map[string]int{"FLOAT": 4, "REAL": 4, "DOUBLE": 8, "DOUBLE PRECISION": 8}
+)
+
+// NormalizeType returns the upper case base type of a column type read from the database,
+// without the length. The synonyms are converted into the types written by the dialects
+func NormalizeType(typ string) string {
+	typ = strings.ToUpper(strings.TrimSpace(typ))
+	if i := strings.Index(typ, "("); i >= 0 {
+		typ = strings.TrimSpace(typ[:i])
+	}
+	switch typ {
+	case "CHARACTER VARYING":
+		return "VARCHAR"
+	case "CHARACTER":
+		return "CHAR"
+	case "TINYTEXT", "MEDIUMTEXT", "LONGTEXT":
+		return "TEXT"
+	case "TIME WITHOUT TIME ZONE":
+		return "TIME"
+	case "TIMESTAMP WITHOUT TIME ZONE":
+		return "TIMESTAMP"
+	}
+	return typ
+}
+
+// GetMigration compares the columns and the index names of the existing table with the log in the
+// dialect, and returns the changes adding the missing columns and indexes and widening the columns.
+// Dropping the columns not in the log and the other type changes are destructive, they are refused
+// unless allowDestructive is true. The types of the columns must be normalized by NormalizeType
+func GetMigration(d Dialect, log def.Logger, tableFullName string, columns []def.ColumnDef, indexNames []string, allowDestructive bool) Migration {
+	m := Migration{Table: tableFullName}
+	table := d.Quote(tableFullName)
+	existing := make(map[string]def.ColumnDef, len(columns))
+	for _, column := range columns {
+		existing[strings.ToLower(column.Name)] = column
+	}
+	fields := GetFields(log, true)
+	wanted := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		name := strings.ToLower(field.Name)
+		wanted[name] = true
+		column, exist := existing[name]
+		typ := d.ColumnType(field)
+		switch {
+		case !exist && name == def.NamePkId:
+			m.Refused = append(m.Refused, "add auto increment column "+field.Name)
+		case !exist:
+			m.add("add column "+field.Name+" "+typ, "ALTER TABLE "+table+" ADD COLUMN "+d.Quote(field.Name)+" "+typ+";")
+		case name == def.NamePkId:
+		default:
+			base, length := NormalizeType(typ), typeLength(typ)
+			if base == column.Type && (length <= column.Length || column.Length <= 0 || length <= 0) {
+				continue
+			}
+			change := "column " + field.Name + " " + columnString(column) + " -> " + strings.ToLower(typ)
+			stmt := d.ModifyColumn(tableFullName, field)
+			if widens(column, base, length) && stmt != "" {
+				m.add("widen "+change, stmt)
+			} else if allowDestructive && stmt != "" {
+				m.add("change "+change, stmt)
+			} else {
+				m.Refused = append(m.Refused, "change "+change)
+			}
+		}
+	}
+	for _, column := range columns {
+		if wanted[strings.ToLower(column.Name)] {
+			continue
+		}
+		if allowDestructive {
+			m.add("drop column "+column.Name, "ALTER TABLE "+table+" DROP COLUMN "+d.Quote(column.Name)+";")
+		} else {
+			m.Refused = append(m.Refused, "drop column "+column.Name)
+		}
+	}
+	exists := make(map[string]bool, len(indexNames))
+	for _, name := range indexNames {
+		exists[strings.ToLower(name)] = true
+	}
+	_, names, indexes := GetKeys(fields)
+	for _, name := range names {
+		if d.InlineIndex() {
+			if !exists[strings.ToLower(name)] {
+				m.add("add index "+name, "ALTER TABLE "+table+" ADD KEY "+d.Quote(name)+" ("+quoteColumns(d, indexes[name], ",")+");")
+			}
+		} else if !exists[strings.ToLower(tableFullName+"_"+name)] {
+			m.add("add index "+name, indexSql(d, tableFullName, name, indexes[name]))
+		}
+	}
+	return m
+}
+
+// add adds a change to apply
+func (m *Migration) add(change, stmt string) {
+	m.Changes = append(m.Changes, change)
+	m.Sqls = append(m.Sqls, stmt)
+}
+
+// typeLength returns the length in the column type like "varchar(255)", or 0 if there is none
+func typeLength(typ string) int32 {
+	start, end := strings.Index(typ, "("), strings.Index(typ, ")")
+	if start < 0 || end < start {
+		return 0
+	}
+	length, _ := strconv.Atoi(strings.TrimSpace(typ[start+1 : end]))
+	return int32(length)
+}
+
+// widens returns whether the column of the type and the length keeps all the values of the column
+func widens(column def.ColumnDef, base string, length int32) bool {
+	switch {
+	case base == column.Type:
+		return length > column.Length
+	case intWidths[base] > 0 && intWidths[column.Type] > 0:
+		return intWidths[base] > intWidths[column.Type]
+	case floatWidths[base] > 0 && floatWidths[column.Type] > 0:
+		return floatWidths[base] > floatWidths[column.Type]
+	case base == "VARCHAR" && column.Type == "CHAR":
+		return length >= column.Length
+	case base == "TEXT":
+		return column.Type == "CHAR" || column.Type == "VARCHAR"
+	}
+	return false
+}
+
+// columnString returns the type of the existing column like "varchar(64)"
+func columnString(column def.ColumnDef) string {
+	if column.Length > 0 && (column.Type == "VARCHAR" || column.Type == "CHAR") {
+		return strings.ToLower(column.Type) + "(" + strconv.Itoa(int(column.Length)) + ")"
+	}
+	return strings.ToLower(column.Type)
+}
+
+// quoteColumns quotes the columns and joins them with sep
+func quoteColumns(d Dialect, columns []string, sep string) string {
+	quoted := make([]string, 0, len(columns))
+	for _, column := range columns {
+		quoted = append(quoted, d.Quote(column))
+	}
+	return strings.Join(quoted, sep)
+}
@@ -0,0 +1,384 @@
+// The wal package provides a segment based write-ahead log on local disk.
+// Every record is appended to the active segment with its sequence number and checksum,
+// and acknowledged when it is not needed any more. The acknowledged sequence numbers of
+// a segment are appended to its ack file, and the segment is deleted when all of its
+// records are acknowledged. The records not acknowledged are returned by Open
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Extensions of the segment files and their ack files
+const (
+	SegmentExt = ".wal"
+	AckExt     = ".ack"
+)
+
+// headerSize is the size of the record header: length, checksum and sequence number
+const headerSize = 4 + 4 + 8
+
+// ErrFull is returned by Append when the log reaches its max size
+var ErrFull = errors.New("write-ahead log full")
+
+// CorruptError is returned when a segment has a truncated or corrupted record
+type CorruptError struct {
+	Path   string // the segment file
+	Offset int    // offset of the corrupted record
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("write-ahead log corrupted: %s at offset %d of %s", e.Reason, e.Offset, e.Path)
+}
+
+// Options of the write-ahead log
+type Options struct {
+	SegmentSize  int64 // the active segment is rotated after it reaches the size
+	MaxSize      int64 // max size of all the segments, unlimited if 0
+	DeleteOldest bool  // delete the oldest segments when MaxSize is reached, instead of returning ErrFull
+	Sync         bool  // fsync the active segment after every append
+}
+
+// Record is a record in the write-ahead log
+type Record struct {
+	Seq  uint64
+	Data []byte
+}
+
+// segment is a segment file, only the last segment is active and appended
+type segment struct {
+	id      uint64
+	first   uint64 // the first sequence number in the segment
+	last    uint64 // the last sequence number in the segment, first - 1 if it is empty
+	size    int64
+	pending int      // how many records are not acknowledged
+	file    *os.File // the segment file, only opened for the active segment
+	ack     *os.File // the ack file, opened at the first acknowledgement
+}
+
+// Log is a write-ahead log in a directory, it is safe for concurrent use
+type Log struct {
+	dir      string
+	opts     Options
+	mu       sync.Mutex
+	seq      uint64 // the last sequence number
+	segments []*segment
+	size     int64 // size of all the segments
+}
+
+// Open opens the write-ahead log in the directory, and returns the records not acknowledged
+// in the order they were appended. The records after a corrupted record of a segment are lost,
+// and the corruption is printed
+func Open(dir string, opts Options) (*Log, []Record, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := make([]uint64, 0)
+	for _, info := range infos {
+		if filepath.Ext(info.Name()) != SegmentExt {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(info.Name(), SegmentExt), 16, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	l := &Log{dir: dir, opts: opts}
+	records := make([]Record, 0)
+	for _, id := range ids {
+		seg := &segment{id: id}
+		segRecords, err := ReadSegment(l.path(id, SegmentExt))
+		if _, corrupted := err.(*CorruptError); err != nil && !corrupted {
+			return nil, nil, err
+		}
+		if err != nil {
+			log.Println(err)
+		}
+		acked, err := readAcks(l.path(id, AckExt))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, record := range segRecords {
+			if seg.first == 0 {
+				seg.first = record.Seq
+			}
+			seg.last = record.Seq
+			if record.Seq > l.seq {
+				l.seq = record.Seq
+			}
+			if !acked[record.Seq] {
+				seg.pending++
+				records = append(records, record)
+			}
+		}
+		if info, err := os.Stat(l.path(id, SegmentExt)); err == nil {
+			seg.size = info.Size()
+		}
+		l.size += seg.size
+		if seg.pending == 0 {
+			l.remove(seg)
+			continue
+		}
+		l.segments = append(l.segments, seg)
+	}
+	return l, records, nil
+}
+
+// ReadSegment reads the records of the segment file. If a record is truncated or its checksum
+// mismatches, the records before it are returned with a *CorruptError
+func ReadSegment(path string) ([]Record, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]Record, 0)
+	for offset := 0; offset < len(content); {
+		if len(content)-offset < headerSize {
+			return records, corrupt(path, offset, "truncated header")
+		}
+		length := int(binary.LittleEndian.Uint32(content[offset:]))
+		sum := binary.LittleEndian.Uint32(content[offset+4:])
+		end := offset + headerSize + length
+		if length < 0 || end > len(content) {
+			return records, corrupt(path, offset, "truncated record")
+		}
+		if crc32.ChecksumIEEE(content[offset+8:end]) != sum {
+			return records, corrupt(path, offset, "checksum mismatch")
+		}
+		records = append(records, Record{
+			Seq:  binary.LittleEndian.Uint64(content[offset+8:]),
+			Data: content[offset+headerSize : end],
+		})
+		offset = end
+	}
+	return records, nil
+}
+
+// corrupt returns the error of the corrupted record at the offset
+func corrupt(path string, offset int, reason string) error {
+	return &CorruptError{Path: path, Offset: offset, Reason: reason}
+}
+
+// readAcks reads the acknowledged sequence numbers in the ack file, a truncated number is ignored
+func readAcks(path string) (map[uint64]bool, error) {
+	acked := make(map[uint64]bool)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return acked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for offset := 0; offset+8 <= len(content); offset += 8 {
+		acked[binary.LittleEndian.Uint64(content[offset:])] = true
+	}
+	return acked, nil
+}
+
+// Append appends the record to the active segment, and returns its sequence number.
+// ErrFull is returned if the log reaches its max size and the oldest segments are not deleted
+func (l *Log) Append(data []byte) (uint64, error) {
+	size := int64(headerSize + len(data))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.opts.MaxSize > 0 && l.size+size > l.opts.MaxSize {
+		if !l.opts.DeleteOldest {
+			return 0, ErrFull
+		}
+		for len(l.segments) > 1 && l.size+size > l.opts.MaxSize {
+			log.Println("Write-ahead log full, delete segment ", l.path(l.segments[0].id, SegmentExt), " with ",
+				l.segments[0].pending, " records not acknowledged")
+			l.remove(l.segments[0])
+			l.segments = l.segments[1:]
+		}
+	}
+	active, err := l.active()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, size)
+	binary.LittleEndian.PutUint32(buf, uint32(len(data)))
+	binary.LittleEndian.PutUint64(buf[8:], l.seq+1)
+	copy(buf[headerSize:], data)
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(buf[8:]))
+	if _, err := active.file.Write(buf); err != nil {
+		return 0, err
+	}
+	if l.opts.Sync {
+		if err := active.file.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	l.seq++
+	if active.first == 0 {
+		active.first = l.seq
+	}
+	active.last = l.seq
+	active.pending++
+	active.size += size
+	l.size += size
+	return l.seq, nil
+}
+
+// active returns the active segment, a new one is created if there is no active segment
+// or the active segment reaches the segment size
+func (l *Log) active() (*segment, error) {
+	if n := len(l.segments); n > 0 {
+		last := l.segments[n-1]
+		if last.file != nil && (l.opts.SegmentSize <= 0 || last.size < l.opts.SegmentSize) {
+			return last, nil
+		}
+		if last.file != nil { // rotate
+			last.file.Close()
+			last.file = nil
+			if last.pending == 0 {
+				l.remove(last)
+				l.segments = l.segments[:n-1]
+			}
+		}
+	}
+	id := uint64(1)
+	if n := len(l.segments); n > 0 {
+		id = l.segments[n-1].id + 1
+	}
+	file, err := os.OpenFile(l.path(id, SegmentExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{id: id, file: file}
+	l.segments = append(l.segments, seg)
+	return seg, nil
+}
+
+// Ack acknowledges the records, the segments whose records are all acknowledged are deleted.
+// The records in the deleted segments are ignored
+func (l *Log) Ack(seqs ...uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bySegment := make(map[*segment][]byte)
+	for _, seq := range seqs {
+		i := sort.Search(len(l.segments), func(i int) bool {
+			return l.segments[i].last >= seq || l.segments[i].first == 0 // an empty active segment is the last one
+		})
+		if i == len(l.segments) || l.segments[i].first == 0 || l.segments[i].first > seq {
+			continue
+		}
+		seg := l.segments[i]
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, seq)
+		bySegment[seg] = append(bySegment[seg], buf...)
+		seg.pending--
+	}
+	var ackErr error
+	for seg, buf := range bySegment {
+		if seg.pending <= 0 && seg.file == nil {
+			l.remove(seg)
+			continue
+		}
+		if seg.ack == nil {
+			ack, err := os.OpenFile(l.path(seg.id, AckExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				ackErr = err
+				continue
+			}
+			seg.ack = ack
+		}
+		if _, err := seg.ack.Write(buf); err != nil {
+			ackErr = err
+		}
+	}
+	segments := l.segments[:0]
+	for _, seg := range l.segments {
+		if seg.pending > 0 || seg.file != nil {
+			segments = append(segments, seg)
+		}
+	}
+	l.segments = segments
+	return ackErr
+}
+
+// Size returns the size of all the segments
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size
+}
+
+// Pending returns how many records are not acknowledged
+func (l *Log) Pending() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pending := 0
+	for _, seg := range l.segments {
+		pending += seg.pending
+	}
+	return pending
+}
+
+// Close closes the segment files, the active segment is deleted if all of its records are
+// acknowledged. The records not acknowledged are returned by the next Open
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var closeErr error
+	for _, seg := range l.segments {
+		if seg.pending <= 0 {
+			l.remove(seg)
+			continue
+		}
+		for _, file := range []*os.File{seg.file, seg.ack} {
+			if file == nil {
+				continue
+			}
+			if l.opts.Sync {
+				file.Sync()
+			}
+			if err := file.Close(); err != nil && closeErr == nil {
+				closeErr = err
+			}
+		}
+		seg.file, seg.ack = nil, nil
+	}
+	l.segments = nil
+	return closeErr
+}
+
+// remove closes and deletes the files of the segment
+func (l *Log) remove(seg *segment) {
+	for _, file := range []*os.File{seg.file, seg.ack} {
+		if file != nil {
+			file.Close()
+		}
+	}
+	seg.file, seg.ack = nil, nil
+	l.size -= seg.size
+	for _, ext := range []string{SegmentExt, AckExt} {
+		if err := os.Remove(l.path(seg.id, ext)); err != nil && !os.IsNotExist(err) {
+			log.Println("Remove write-ahead log ", l.path(seg.id, ext), " error!")
+			log.Println(err)
+		}
+	}
+}
+
+// path returns the path of the segment file or its ack file
+func (l *Log) path(id uint64, ext string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016x%s", id, ext))
+}